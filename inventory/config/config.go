@@ -14,24 +14,54 @@ type Settings struct {
 		LdapGroups []string `yaml:"ldap_groups" json:"ldap_groups"`
 	} `yaml:"ssh" json:"ssh"`
 	AWS struct {
+		// How accounts are reached.  By default each account is the shared
+		// config profile of the same name.  With mode "assume_role" the base
+		// identity (base_profile, or the default credential chain) assumes
+		// role_name in every account by its accountno.
+		Auth struct {
+			Mode string `yaml:"mode" json:"mode"`
+			BaseProfile string `yaml:"base_profile" json:"base_profile"`
+			RoleName string `yaml:"role_name" json:"role_name"`
+			ExternalID string `yaml:"external_id" json:"external_id"`
+			ExternalIDEnv string `yaml:"external_id_env" json:"external_id_env"`
+			// Defaults to "goinventory".
+			SessionName string `yaml:"session_name" json:"session_name"`
+			// How long assumed credentials last, such as "1h".
+			Duration string `yaml:"duration" json:"duration"`
+			// Region of the STS endpoint.  Defaults to us-east-1.
+			Region string `yaml:"region" json:"region"`
+		} `yaml:"auth" json:"auth"`
 		Accounts map[string]struct {
 			AccountNo string `yaml:"accountno" json:"accountno"`
+			// Shared config profile to use for this account even when
+			// assuming roles.
+			Profile string `yaml:"profile" json:"profile"`
 			Env string `yaml:"env" json:"env"`
 			FalconEnv string `yaml:"falcon-env" json:"falcon-env"`
+			// Region (name or short code) or "default" to a proxies entry or
+			// a [user@]host[:port] to reach instances through.
 			JumpHosts map[string]string `yaml:"jump_hosts" json:"jump_hosts"`
+			// "domain" is the directory instances must be joined to; "groups"
+			// lists required groups in addition to ssh.ldap_groups.
 			LDAP map[string]string `yaml:"ldap" json:"ldap"`
 			SplunkDir string `yaml:"splunk_dir" json:"splunk_dir"`
 		} `yaml:"accounts" json:"accounts"`
+		// Rolls scan the regions flagged default, or all of them if none
+		// is.
 		Regions map[string] struct {
 			DefaultValue bool `yaml:"default" json:"default"`
 			Short string `yaml:"short" json:"short"`
 			Location string `yaml:"location" json:"location"`
 		} `yaml:"regions" json:"regions"`
+		// Also scan the regions enabled in an account that aren't listed
+		// in regions.
+		DiscoverRegions bool `yaml:"discover_regions" json:"discover_regions"`
 	} `yaml:"aws" json:"aws"`
 	Azure struct {
 		Accounts map[string] struct {
 			Id string `yaml:"id" json:"id"`
 			Name string `yaml:"name" json:"name"`
+			Env string `yaml:"env" json:"env"`
 		} `yaml:"accounts" json:"accounts"`
 		Regions map[string] struct {
 			DefaultValue bool `yaml:"default" json:"default"`
@@ -39,18 +69,58 @@ type Settings struct {
 			Location string `yaml:"location" json:"location"`
 		} `yaml:"regions" json:"regions"`
 	} `yaml:"azure" json:"azure"`
+	Static struct {
+		// Host files (YAML or CSV) or directories of them.
+		Sources []string `yaml:"sources" json:"sources"`
+	} `yaml:"static" json:"static"`
 	CMDB map[string]string `yaml:"cmdb" json:"cmdb"`
+	Notify []NotifyTarget `yaml:"notify" json:"notify"`
+	Log struct {
+		// debug, info, warn or error.  Defaults to info.
+		Level string `yaml:"level" json:"level"`
+		// text or json.  Defaults to text.
+		Format string `yaml:"format" json:"format"`
+		// Written instead of stderr; relative to datadir.
+		File string `yaml:"file" json:"file"`
+	} `yaml:"log" json:"log"`
 	Inventory struct {
 		Datadir string `yaml:"datadir" json:"datadir"`
 		SkipOnNoCreds bool `yaml:"skip_on_no_creds" json:"skip_on_no_creds"`
 		MaxBackups int `yaml:"max_backups" json:"max_backups"`
+		// Refuse to mark more than this percentage of the active instances
+		// of a scanned scope terminated in one run, unless it is only one
+		// or two.  Defaults to 25.
+		MaxTerminatePercent int `yaml:"max_terminate_percent" json:"max_terminate_percent"`
 		ExplicitKeys bool `yaml:"explicit_keys" json:"explicit_keys"`
 		Ec2_required_tags []string `yaml:"ec2_required_tags" json:"ec2_required_tags"`
 		Users []string `yaml:"users" json:"users"`
 		FirstAttempts []string `yaml:"first_attempts" json:"first_attempts"`
 		KeyBlacklist []string `yaml:"key_blacklist" json:"key_blacklist"`
 		Keys []string `yaml:"keys" json:"keys"`
+		KeyMap map[string]string `yaml:"key_map" json:"key_map"`
 		OsMap map[string]string `yaml:"os_map" json:"os_map"`
+		// Managed OpenSSH include file.  Defaults to ~/.ssh/inventory.conf.
+		SSHConfig string `yaml:"ssh_config" json:"ssh_config"`
+		// Template exported hosts are named with, over the instance fields,
+		// such as "{{.Name}}.{{.Region|short}}.{{.ENV}}".  Defaults to the
+		// instance name.
+		HostName string `yaml:"host_name" json:"host_name"`
+		// Prometheus textfile collector file written after every roll.
+		MetricsFile string `yaml:"metrics_file" json:"metrics_file"`
+		// How often daemon mode rolls, plus up to jitter at random
+		// (durations such as "1h" and "5m").
+		Interval string `yaml:"interval" json:"interval"`
+		Jitter string `yaml:"jitter" json:"jitter"`
+		// Limits on a roll as a whole and on its phases, as durations.
+		// Unset means no limit, except ssh, a single connection attempt,
+		// which defaults to 5s.
+		Timeouts struct {
+			Run string `yaml:"run" json:"run"`
+			Scan string `yaml:"scan" json:"scan"`
+			Logins string `yaml:"logins" json:"logins"`
+			Facts string `yaml:"facts" json:"facts"`
+			SSH string `yaml:"ssh" json:"ssh"`
+		} `yaml:"timeouts" json:"timeouts"`
 	} `yaml:"inventory" json:"inventory"`
 	Proxies map[string] struct{
 		Description string `yaml:"description" json:"description"`
@@ -62,12 +132,30 @@ type Settings struct {
 	} `yaml:"proxies" json:"proxies"`
 }
 
+// NotifyTarget is somewhere to send the changes found by a roll.  Type is
+// "webhook" (generic JSON), "slack", "teams" or "email".  Events and
+// Accounts (globs) narrow what it gets; empty means everything.
+type NotifyTarget struct {
+	Name string `yaml:"name" json:"name"`
+	Type string `yaml:"type" json:"type"`
+	URL string `yaml:"url" json:"url"`
+	URLEnv string `yaml:"url_env" json:"url_env"`
+	Events []string `yaml:"events" json:"events"`
+	Accounts []string `yaml:"accounts" json:"accounts"`
+	// Email only.  SMTP is host:port.
+	SMTP string `yaml:"smtp" json:"smtp"`
+	From string `yaml:"from" json:"from"`
+	To []string `yaml:"to" json:"to"`
+	User string `yaml:"user" json:"user"`
+	PasswordEnv string `yaml:"password_env" json:"password_env"`
+}
+
 // func printLine() {
 // 	_, _, line, _ := runtime.Caller(1)
 // 	fmt.Printf("Line: %d\n", line)
 // }
 
-func parseTilde(filename string) (string) {
+func ParseTilde(filename string) (string) {
 	if strings.HasPrefix(filename, "~/") {
 		dirname, err := os.UserHomeDir()
 		if err != nil {
@@ -80,31 +168,34 @@ func parseTilde(filename string) (string) {
 }
 
 func NewConfig(configFile string) (*Settings) {
-	var err error
-	var fullConfigFilename string
-	var yamlFileContents []byte
+	s, err := LoadConfig(configFile)
+	if err != nil {
+		panic(err.Error() + "\n")
+	}
+	return s
+}
+
+// LoadConfig is NewConfig returning errors instead of panicking, for
+// reloading a running process.
+func LoadConfig(configFile string) (*Settings, error) {
 	var s Settings
 
-	fullConfigFilename, err = filepath.Abs(configFile)
+	fullConfigFilename, err := filepath.Abs(configFile)
 	if err != nil {
-		//  Panic.
-		msg := fmt.Sprintf("Unable to get config file path: %s\n", err)
-		panic(msg)
+		return nil, fmt.Errorf("Unable to get config file path: %s", err)
 	}
-	fullConfigFilename = parseTilde(fullConfigFilename)
-	
-	yamlFileContents, err = os.ReadFile(fullConfigFilename)
+	fullConfigFilename = ParseTilde(fullConfigFilename)
+
+	yamlFileContents, err := os.ReadFile(fullConfigFilename)
 	if err != nil {
-		msg := fmt.Sprintf("Unable to read config file: %s\n", err)
-		panic(msg)
+		return nil, fmt.Errorf("Unable to read config file: %s", err)
 	}
 
 	err = yaml.Unmarshal(yamlFileContents, &s)
 	if err != nil {
-		msg := fmt.Sprintf("Unable to parse config file: %s\n", err)
-		panic(msg)
+		return nil, fmt.Errorf("Unable to parse config file: %s", err)
 	}
-	return &s
+	return &s, nil
 }
 
 type Settingser interface {
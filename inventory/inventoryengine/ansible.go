@@ -0,0 +1,350 @@
+package inventoryengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+	"gopkg.in/yaml.v3"
+)
+
+// AnsibleFormats are the formats understood by ExportAnsible.
+var AnsibleFormats = []string{"ansible-ini", "ansible-yaml", "ansible-json"}
+
+// AnsibleInventory is an Ansible inventory: hosts with their variables and
+// groups of host names.  Hosts are grouped by account, provider, region, env
+// and OS, each with its own prefix so an account named after a provider,
+// or after Ansible's all and ungrouped, stays a group of its own.
+type AnsibleInventory struct {
+	HostVars  map[string]map[string]any
+	Groups    map[string][]string
+	GroupVars map[string]map[string]any
+}
+
+// ansibleName makes a string usable as an Ansible group name.
+func ansibleName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(name))
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// BuildAnsibleInventory groups instances and collects their variables.
+// Hosts are named by names.
+func BuildAnsibleInventory(c *config.Settings, instances []Instance, names *HostNames) *AnsibleInventory {
+	inv := &AnsibleInventory{
+		HostVars:  make(map[string]map[string]any),
+		Groups:    make(map[string][]string),
+		GroupVars: make(map[string]map[string]any),
+	}
+	for _, instance := range instances {
+		if instance.Skip {
+			continue
+		}
+		address, err := instance.GetConnectionAddress()
+		if err != nil {
+			continue
+		}
+		host := names.Name(instance)
+
+		vars := map[string]any{
+			"ansible_host":   address,
+			"instance_id":    instance.ID,
+			"cloud_provider": instance.CloudProvider,
+			"account":        instance.Account,
+			"region":         instance.Region,
+		}
+		if instance.User != "" {
+			vars["ansible_user"] = instance.User
+		}
+		if instance.SSHPort != "" && instance.SSHPort != "22" {
+			vars["ansible_port"] = instance.SSHPort
+		}
+		if instance.SSHKey != "" {
+			vars["ansible_ssh_private_key_file"] = instance.SSHKey
+		}
+		if jump, proxy := jumpHost(c, instance); jump != "" {
+			if instance.PrivateIP != "" {
+				vars["ansible_host"] = instance.PrivateIP
+			}
+			if proxy != nil {
+				jump = proxy.HostName
+				if proxy.User != "" {
+					jump = proxy.User + "@" + jump
+				}
+				if proxy.Port != "" {
+					jump += ":" + proxy.Port
+				}
+			}
+			vars["ansible_ssh_common_args"] = "-o ProxyJump=" + jump
+		}
+		for _, field := range []string{"env", "os", "name", "private_ip", "public_ip", "size", "state"} {
+			if value, _ := FieldValue(instance, field); value != "" {
+				vars[field] = value
+			}
+		}
+		if len(instance.Tags) > 0 {
+			vars["tags"] = instance.Tags
+		}
+		inv.HostVars[host] = vars
+
+		groups := [][2]string{
+			{"account_", instance.Account},
+			{"provider_", instance.CloudProvider},
+			{"region_", instance.Region},
+			{"env_", instance.ENV},
+			{"os_", instance.OS},
+		}
+		for _, group := range groups {
+			if group[1] == "" {
+				continue
+			}
+			name := ansibleName(group[0] + group[1])
+			inv.Groups[name] = append(inv.Groups[name], host)
+		}
+	}
+
+	for name, account := range c.AWS.Accounts {
+		group := ansibleName("account_" + name)
+		if _, ok := inv.Groups[group]; !ok {
+			continue
+		}
+		vars := make(map[string]any)
+		for k, v := range map[string]string{
+			"account_no": account.AccountNo,
+			"env":        account.Env,
+			"falcon_env": account.FalconEnv,
+			"splunk_dir": account.SplunkDir,
+		} {
+			if v != "" {
+				vars[k] = v
+			}
+		}
+		if len(vars) > 0 {
+			inv.GroupVars[group] = vars
+		}
+	}
+
+	for group := range inv.Groups {
+		sort.Strings(inv.Groups[group])
+	}
+	return inv
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteINI writes the hosts file in INI format.  Variables are left to the
+// group_vars and host_vars files.
+func (inv *AnsibleInventory) WriteINI(w io.Writer) error {
+	fmt.Fprintf(w, "# Managed by goinventory, %s.\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintln(w, "[all]")
+	for _, host := range sortedKeys(inv.HostVars) {
+		fmt.Fprintln(w, host)
+	}
+	for _, group := range sortedKeys(inv.Groups) {
+		fmt.Fprintf(w, "\n[%s]\n", group)
+		for _, host := range inv.Groups[group] {
+			fmt.Fprintln(w, host)
+		}
+	}
+	return nil
+}
+
+// WriteYAML writes the hosts file in Ansible's YAML inventory format.
+func (inv *AnsibleInventory) WriteYAML(w io.Writer) error {
+	hosts := make(map[string]any)
+	for host := range inv.HostVars {
+		hosts[host] = nil
+	}
+	children := make(map[string]any)
+	for group, members := range inv.Groups {
+		groupHosts := make(map[string]any)
+		for _, host := range members {
+			groupHosts[host] = nil
+		}
+		children[group] = map[string]any{"hosts": groupHosts}
+	}
+	doc := map[string]any{
+		"all": map[string]any{
+			"hosts":    hosts,
+			"children": children,
+		},
+	}
+	fmt.Fprintf(w, "# Managed by goinventory, %s.\n", time.Now().UTC().Format(time.RFC3339))
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// WriteJSON writes the inventory in the dynamic inventory script format
+// (the output of --list), host variables included under _meta.
+func (inv *AnsibleInventory) WriteJSON(w io.Writer) error {
+	doc := map[string]any{
+		"all": map[string]any{
+			"hosts":    sortedKeys(inv.HostVars),
+			"children": sortedKeys(inv.Groups),
+		},
+		"_meta": map[string]any{"hostvars": inv.HostVars},
+	}
+	for group, hosts := range inv.Groups {
+		entry := map[string]any{"hosts": hosts}
+		if vars, ok := inv.GroupVars[group]; ok {
+			entry["vars"] = vars
+		}
+		doc[group] = entry
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(doc)
+}
+
+func writeYAMLFile(file string, value any) error {
+	return WriteFileAtomic(file, 0o644, func(w io.Writer) error {
+		fmt.Fprintln(w, "---")
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+		return enc.Close()
+	})
+}
+
+// WriteTree writes the hosts file, group_vars and host_vars into dir.
+func (inv *AnsibleInventory) WriteTree(dir string, format string) error {
+	var hostsFile string
+	var write func(io.Writer) error
+	switch format {
+	case "ansible-ini":
+		hostsFile, write = "hosts", inv.WriteINI
+	case "ansible-yaml":
+		hostsFile, write = "hosts.yml", inv.WriteYAML
+	default:
+		return fmt.Errorf("unknown format %q (want ansible-ini or ansible-yaml)", format)
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, hostsFile), 0o644, write); err != nil {
+		return err
+	}
+	for group, vars := range inv.GroupVars {
+		if err := writeYAMLFile(filepath.Join(dir, "group_vars", group+".yml"), vars); err != nil {
+			return err
+		}
+	}
+	for host, vars := range inv.HostVars {
+		if err := writeYAMLFile(filepath.Join(dir, "host_vars", host+".yml"), vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Datadir is where the inventory keeps generated files, "." unless the
+// datadir setting says otherwise.
+func (i *Inventory) Datadir() string {
+	dir := i.Config().Inventory.Datadir
+	if dir == "" {
+		return "."
+	}
+	return config.ParseTilde(dir)
+}
+
+// ExportAnsible writes a static inventory for the instances matching the
+// filter.  The tree is written to a new generation directory under datadir
+// and <datadir>/ansible, a symlink, is switched to it in one rename, so
+// Ansible never reads a half written inventory.  max_backups older
+// generations are kept.  It returns the path of the new generation.
+func (i *Inventory) ExportAnsible(filter Filter, format string) (string, error) {
+	instances, err := i.FindInstances(filter)
+	if err != nil {
+		return "", err
+	}
+	names, err := NewHostNames(i.Config(), instances)
+	if err != nil {
+		return "", err
+	}
+	names.warnDuplicates("ansible")
+	inv := BuildAnsibleInventory(i.Config(), instances, names)
+
+	datadir := i.Datadir()
+	if err := os.MkdirAll(datadir, 0o755); err != nil {
+		return "", err
+	}
+	gen, err := os.MkdirTemp(datadir, "ansible-"+time.Now().UTC().Format("20060102T150405.000000Z")+"-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(gen, 0o755); err != nil {
+		return gen, err
+	}
+	if err := inv.WriteTree(gen, format); err != nil {
+		os.RemoveAll(gen)
+		return "", err
+	}
+
+	link := filepath.Join(datadir, "ansible")
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// A plain directory left by hand or by an older version.
+		if err := os.Rename(link, filepath.Join(datadir, "ansible-00000000T000000.000000Z-old")); err != nil {
+			return gen, err
+		}
+	}
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(gen), tmp); err != nil {
+		return gen, err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		return gen, err
+	}
+	return gen, pruneGenerations(datadir, "ansible-", filepath.Base(gen), i.Config().Inventory.MaxBackups)
+}
+
+// pruneGenerations removes all but the newest keep generations, files or
+// directories, besides the current one.  Generation names sort by time.
+func pruneGenerations(dir string, prefix string, current string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	old := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) && entry.Name() != current {
+			old = append(old, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(old)))
+	for n, name := range old {
+		if n < keep {
+			continue
+		}
+		slog.Debug("Removing old generation", "name", name)
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
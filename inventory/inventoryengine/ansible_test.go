@@ -0,0 +1,50 @@
+package inventoryengine
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildAnsibleInventoryGroups(t *testing.T) {
+	c := testSettings(t, `
+aws:
+  accounts:
+    aws: {accountno: "123456789012", env: prod}
+`)
+	instances := []Instance{
+		{ID: "i-1", Name: "web1", PrivateIP: "10.0.0.1", CloudProvider: "aws", Account: "aws", Region: "us-east-1", ENV: "prod"},
+		{ID: "i-2", Name: "web2", PrivateIP: "10.0.0.2", CloudProvider: "aws", Account: "all"},
+		{ID: "static-db1", Name: "db1", PrivateIP: "192.0.2.1", CloudProvider: "static", Account: "colo"},
+	}
+	names, err := NewHostNames(c, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := BuildAnsibleInventory(c, instances, names)
+
+	want := map[string][]string{
+		"account_aws":      {"web1"},
+		"account_all":      {"web2"},
+		"account_colo":     {"db1"},
+		"provider_aws":     {"web1", "web2"},
+		"provider_static":  {"db1"},
+		"region_us_east_1": {"web1"},
+		"env_prod":         {"web1"},
+	}
+	for group, hosts := range want {
+		if !slices.Equal(inv.Groups[group], hosts) {
+			t.Errorf("group %s = %v, want %v", group, inv.Groups[group], hosts)
+		}
+	}
+	for _, group := range []string{"aws", "all", "static", "colo"} {
+		if _, ok := inv.Groups[group]; ok {
+			t.Errorf("unprefixed group %s", group)
+		}
+	}
+	if vars := inv.GroupVars["account_aws"]; vars["account_no"] != "123456789012" {
+		t.Errorf("account_aws vars = %v", vars)
+	}
+	if _, ok := inv.GroupVars["provider_aws"]; ok {
+		t.Error("account vars applied to the provider group")
+	}
+}
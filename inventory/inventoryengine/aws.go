@@ -3,28 +3,48 @@ package inventoryengine
 import (
 	"context"
 	//"sync"
-	//"github.com/aws/aws-sdk-go-v2/aws"
 	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 
 	invconfig "github.com/ascheel/goinventory/inventory/config"
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
+// AWS is the EC2 provider.  It scans every configured account (shared config
+// profile, or a role assumed into it) in the regions Regions picks.
 type AWS struct {
-	Profile string
-	Region string
-	EC2 ec2.Client
-	Instances map[string]Instance
+	Selection Selection
+	config *invconfig.Settings
+	keyPairs map[string]KeyPair
+	// STS client of the base identity and the assumed role credentials
+	// by account, in assume_role mode.
+	base *sts.Client
+	credentials map[string]aws.CredentialsProvider
 }
 
-func NewAWS() *AWS {
-	instance := &AWS{}
+func NewAWS(c *invconfig.Settings) *AWS {
+	instance := &AWS{
+		config: c,
+		keyPairs: make(map[string]KeyPair),
+		credentials: make(map[string]aws.CredentialsProvider),
+	}
 	return instance
 }
 
+func (a *AWS) Name() string {
+	return "aws"
+}
+
+func (a *AWS) KeyPairs() map[string]KeyPair {
+	return a.keyPairs
+}
+
 type EC2DescribeInstancesAPI interface {
 	DescribeInstances(
 		ctx context.Context,
@@ -37,66 +57,162 @@ func GetInstances(c context.Context, api EC2DescribeInstancesAPI, input *ec2.Des
 	return api.DescribeInstances(c, input)
 }
 
-func (a *AWS) RefreshInstances() {
-	a.Instances = make(map[string]Instance)
-	a.GetInstances()
+type EC2DescribeKeyPairsAPI interface {
+	DescribeKeyPairs(
+		ctx context.Context,
+		params *ec2.DescribeKeyPairsInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DescribeKeyPairsOutput, error)
+}
+
+func GetKeyPairs(c context.Context, api EC2DescribeKeyPairsAPI, input *ec2.DescribeKeyPairsInput) (*ec2.DescribeKeyPairsOutput, error) {
+	return api.DescribeKeyPairs(c, input)
 }
 
-func (a *AWS) GetInstanceList() ([]string) {
-	instances := make([]string, 0)
-	for id := range a.Instances {
-		instances = append(instances, id)
+func (a *AWS) Discover(ctx context.Context) ([]Instance, []ScopeResult) {
+	slog.DebugContext(ctx, "Getting instances.")
+	instances := make([]Instance, 0)
+	results := make([]ScopeResult, 0)
+
+	for _, profile := range sortedKeys(a.config.AWS.Accounts) {
+		account := a.config.AWS.Accounts[profile]
+		if !a.Selection.Account(profile, account.AccountNo) || !a.Selection.Env(account.Env) {
+			continue
+		}
+		regions := a.Regions(ctx, profile)
+		if len(regions) == 0 {
+			slog.WarnContext(ctx, "No region to scan", "account", profile, "regions", strings.Join(a.Selection.Regions, ","))
+		}
+		for _, region := range regions {
+			scope := Scope{Provider: a.Name(), Account: profile, Region: region}
+			found, result := scanScope(ctx, scope, func(ctx context.Context) ([]Instance, error) {
+				slog.InfoContext(ctx, "Checking region")
+				return a.scan(ctx, profile, region)
+			})
+			instances = append(instances, found...)
+			results = append(results, result)
+		}
 	}
-	return instances
+	return instances, results
 }
 
-func (a *AWS) GetInstances() map[string]Instance {
-	log.Debug("Getting instances.")
-	c := invconfig.NewConfig("de_test.yml")
-
-	if a.Instances == nil {
-		a.Instances = make(map[string]Instance)
-		var profile string
-		var region string
-
-		count := 0
-		for profile = range c.AWS.Accounts {
-			log.Infof("Checking profile %s\n", profile)
-			for region = range c.AWS.Regions {
-				log.Infof("Checking region %s\n", region)
-				cfg, err := config.LoadDefaultConfig(
-					context.TODO(),
-					config.WithRegion(region),
-					config.WithSharedConfigProfile(profile),
-				)
-				if err != nil {
-					log.Errorf("Unable to set AWS config: %v\n", err)
-				}
-				client := ec2.NewFromConfig(cfg)
-				input := &ec2.DescribeInstancesInput{}
-
-				result, err := GetInstances(context.TODO(), client, input)
-				if err != nil {
-					log.Fatalf("Unable to get instances: %v\n", err)
-				}
-				for _, r := range result.Reservations {
-					for _, i := range r.Instances {
-						count += 1
-						log.Debugf("Found instance: %s (%d)\n", *i.InstanceId, count)
-						_instance := a.TranslateInstance(i)
-						_instance.Account = profile
-						_instance.Region = region
-						_instance.ENV = c.AWS.Accounts[profile].Env
-						a.Instances[_instance.ID] = _instance
-					}
-				}
+// Regions lists the regions to scan in an account.  Normally these are the
+// configured regions flagged default, or all of them if none is, plus those
+// found by discover_regions.  AllRegions takes every region, and selected
+// regions are scanned whether flagged default or not.
+func (a *AWS) Regions(ctx context.Context, profile string) []string {
+	configured := a.config.AWS.Regions
+	anyDefault := false
+	for _, r := range configured {
+		anyDefault = anyDefault || r.DefaultValue
+	}
+	every := a.Selection.AllRegions || len(a.Selection.Regions) > 0 || !anyDefault
+
+	regions := make([]string, 0)
+	for _, name := range sortedKeys(configured) {
+		r := configured[name]
+		if (every || r.DefaultValue) && a.Selection.Region(name, r.Short) {
+			regions = append(regions, name)
+		}
+	}
+	if a.config.AWS.DiscoverRegions {
+		discovered, err := a.discoverRegions(ctx, profile)
+		if err != nil {
+			slog.WarnContext(ctx, "Unable to discover regions", "account", profile, "err", err)
+		}
+		for _, name := range discovered {
+			if _, ok := configured[name]; !ok && a.Selection.Region(name) {
+				slog.InfoContext(ctx, "Found a region missing from the settings", "account", profile, "region", name)
+				regions = append(regions, name)
 			}
 		}
 	}
-	return a.Instances
+	return regions
+}
+
+// discoverRegions lists the regions enabled in an account.
+func (a *AWS) discoverRegions(ctx context.Context, profile string) ([]string, error) {
+	home := "us-east-1"
+	for _, name := range sortedKeys(a.config.AWS.Regions) {
+		if a.config.AWS.Regions[name].DefaultValue {
+			home = name
+			break
+		}
+	}
+	cfg, err := a.awsConfig(ctx, profile, home)
+	if err != nil {
+		return nil, err
+	}
+	result, err := ec2.NewFromConfig(cfg).DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, 0, len(result.Regions))
+	for _, r := range result.Regions {
+		if r.RegionName != nil {
+			regions = append(regions, *r.RegionName)
+		}
+	}
+	sort.Strings(regions)
+	return regions, nil
 }
 
-func (a *AWS) TranslateInstance(instance types.Instance) Instance {
+// scan lists the instances of one profile/region.
+func (a *AWS) scan(ctx context.Context, profile string, region string) ([]Instance, error) {
+	instances := make([]Instance, 0)
+	cfg, err := a.awsConfig(ctx, profile, region)
+	if err != nil {
+		return instances, fmt.Errorf("unable to set AWS config: %w", err)
+	}
+	client := ec2.NewFromConfig(cfg)
+
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return instances, fmt.Errorf("unable to get instances: %w", err)
+		}
+		for _, r := range result.Reservations {
+			for _, i := range r.Instances {
+				_instance := TranslateInstance(i)
+				_instance.Account = profile
+				_instance.Region = region
+				_instance.ENV = a.config.AWS.Accounts[profile].Env
+				slog.DebugContext(ctx, "Found instance", "instance", _instance.ID)
+				instances = append(instances, _instance)
+			}
+		}
+	}
+	a.ReadKeyPairs(ctx, client, profile, region)
+	return instances, nil
+}
+
+// ReadKeyPairs records the EC2 key pairs of one account/region so that login
+// discovery can match them against local private keys.  Failure is not fatal;
+// discovery simply falls back to trying every key.
+func (a *AWS) ReadKeyPairs(ctx context.Context, api EC2DescribeKeyPairsAPI, profile string, region string) {
+	input := &ec2.DescribeKeyPairsInput{IncludePublicKey: aws.Bool(true)}
+	result, err := GetKeyPairs(ctx, api, input)
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to get key pairs", "err", err)
+		return
+	}
+	for _, k := range result.KeyPairs {
+		if k.KeyName == nil {
+			continue
+		}
+		kp := KeyPair{Name: *k.KeyName}
+		if k.KeyFingerprint != nil {
+			kp.Fingerprint = *k.KeyFingerprint
+		}
+		if k.PublicKey != nil {
+			kp.PublicKey = *k.PublicKey
+		}
+		a.keyPairs[KeyPairScope(profile, region, kp.Name)] = kp
+	}
+}
+
+func TranslateInstance(instance types.Instance) Instance {
 	name, err := GetTag(instance.Tags, "Name")
 	if err != nil {
 		name = ""
@@ -113,32 +229,38 @@ func (a *AWS) TranslateInstance(instance types.Instance) Instance {
 	if instance.VpcId != nil {
 		vpcid = *instance.VpcId
 	}
+	privateIP := ""
+	if instance.PrivateIpAddress != nil {
+		privateIP = *instance.PrivateIpAddress
+	}
+	publicIP := ""
+	if instance.PublicIpAddress != nil {
+		publicIP = *instance.PublicIpAddress
+	}
+	tags := make(map[string]string)
+	for _, tag := range instance.Tags {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
 	i := Instance{
 		ID: *instance.InstanceId,
 		AMI: *instance.ImageId,
+		CloudProvider: "aws",
 		KeypairName: keyname,
 		LaunchTime: *instance.LaunchTime,
 		Name: name,
+		PrivateIP: privateIP,
+		PublicIP: publicIP,
+		Size: string(instance.InstanceType),
 		State: string(instance.State.Name),
 		Subnet: subnet,
+		Tags: tags,
 		VPC: vpcid,
 	}
 	return i
 }
 
-func (a *AWS) Init() error {
-	a.Profile = "na-ea-dev"
-	a.Region  = "us-east-1"
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return err
-	}
-
-	a.EC2 = *ec2.NewFromConfig(cfg)
-
-	return nil
-}
-
 func GetTag(tags []types.Tag, tag string) (string, error) {
 	//func GetTag(tags []map[string]string, tag string) (string) {
 		for _, item := range tags {
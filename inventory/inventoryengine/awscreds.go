@@ -0,0 +1,119 @@
+package inventoryengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// AWSAuthModes are the values aws.auth.mode can take.
+var AWSAuthModes = []string{"profile", "assume_role"}
+
+// DefaultAWSSessionName names assumed role sessions unless
+// aws.auth.session_name is set.
+const DefaultAWSSessionName = "goinventory"
+
+// awsConfig returns the SDK config for an account in a region: its shared
+// config profile, or credentials for the role assumed into it.
+func (a *AWS) awsConfig(ctx context.Context, profile string, region string) (aws.Config, error) {
+	auth := a.config.AWS.Auth
+	account := a.config.AWS.Accounts[profile]
+	switch auth.Mode {
+	case "", "profile":
+	case "assume_role":
+		if account.Profile == "" {
+			creds, err := a.roleCredentials(ctx, profile)
+			if err != nil {
+				return aws.Config{}, err
+			}
+			return config.LoadDefaultConfig(ctx, config.WithRegion(region), config.WithCredentialsProvider(creds))
+		}
+	default:
+		return aws.Config{}, fmt.Errorf("unknown aws.auth.mode %q, want %s", auth.Mode, strings.Join(AWSAuthModes, " or "))
+	}
+	if account.Profile != "" {
+		profile = account.Profile
+	}
+	return config.LoadDefaultConfig(ctx, config.WithRegion(region), config.WithSharedConfigProfile(profile))
+}
+
+// AWSRoleARN is the role assumed into an account.  A role_name that already
+// is an ARN is used as it is, with any %s replaced by the account number.
+func AWSRoleARN(roleName string, accountNo string) string {
+	if strings.HasPrefix(roleName, "arn:") {
+		if strings.Contains(roleName, "%s") {
+			return fmt.Sprintf(roleName, accountNo)
+		}
+		return roleName
+	}
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s", accountNo, strings.TrimPrefix(roleName, "/"))
+}
+
+// roleCredentials returns the assumed role credentials of an account.  They
+// are cached and refreshed before they expire, so every region of the
+// account, and later rolls, share one session.
+func (a *AWS) roleCredentials(ctx context.Context, profile string) (aws.CredentialsProvider, error) {
+	if creds, ok := a.credentials[profile]; ok {
+		return creds, nil
+	}
+	auth := a.config.AWS.Auth
+	accountNo := a.config.AWS.Accounts[profile].AccountNo
+	if accountNo == "" {
+		return nil, fmt.Errorf("account %s has no accountno to assume a role into", profile)
+	}
+	if auth.RoleName == "" {
+		return nil, errors.New("aws.auth.role_name is not set")
+	}
+	var duration time.Duration
+	if auth.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(auth.Duration); err != nil || duration <= 0 {
+			return nil, fmt.Errorf("bad aws.auth.duration %q", auth.Duration)
+		}
+	}
+	externalID := auth.ExternalID
+	if auth.ExternalIDEnv != "" {
+		externalID = os.Getenv(auth.ExternalIDEnv)
+	}
+	sessionName := auth.SessionName
+	if sessionName == "" {
+		sessionName = DefaultAWSSessionName
+	}
+
+	if a.base == nil {
+		region := auth.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+		if auth.BaseProfile != "" {
+			opts = append(opts, config.WithSharedConfigProfile(auth.BaseProfile))
+		}
+		base, err := config.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the base AWS identity: %w", err)
+		}
+		a.base = sts.NewFromConfig(base)
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(a.base, AWSRoleARN(auth.RoleName, accountNo), func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = sessionName
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+		if duration > 0 {
+			o.Duration = duration
+		}
+	})
+	creds := aws.NewCredentialsCache(provider)
+	a.credentials[profile] = creds
+	return creds, nil
+}
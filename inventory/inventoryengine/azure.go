@@ -0,0 +1,469 @@
+package inventoryengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	invconfig "github.com/ascheel/goinventory/inventory/config"
+)
+
+const (
+	azureManagementURL = "https://management.azure.com"
+	azureLoginURL      = "https://login.microsoftonline.com"
+	azureComputeAPI    = "2023-03-01"
+	azureNetworkAPI    = "2023-05-01"
+)
+
+var errNoAzureCredentials = fmt.Errorf("%w: set AZURE_ACCESS_TOKEN or AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET", ErrNoCredentials)
+
+// azureTokenMargin is how long before it expires a token is replaced.
+const azureTokenMargin = 5 * time.Minute
+
+// Azure lists virtual machines through the ARM REST API, one scope per
+// subscription and configured region, or per subscription if no regions are
+// configured.  BaseURL and LoginURL can be pointed at a stand-in server.
+type Azure struct {
+	BaseURL  string
+	LoginURL string
+	Client   *http.Client
+	Token    string
+	// When Token expires; zero for a token given in AZURE_ACCESS_TOKEN.
+	Expires time.Time
+	// Narrows the subscriptions by account and env, and the regions.
+	Selection Selection
+	config    *invconfig.Settings
+}
+
+func NewAzure(c *invconfig.Settings) *Azure {
+	instance := &Azure{
+		BaseURL:  azureManagementURL,
+		LoginURL: azureLoginURL,
+		Client:   &http.Client{Timeout: 60 * time.Second},
+		Token:    os.Getenv("AZURE_ACCESS_TOKEN"),
+		config:   c,
+	}
+	return instance
+}
+
+func (a *Azure) Name() string {
+	return "azure"
+}
+
+// ARM response shapes, reduced to the fields we use.
+type azureList[T any] struct {
+	Value    []T    `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+type azureVM struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Location   string            `json:"location"`
+	Tags       map[string]string `json:"tags"`
+	Properties struct {
+		VMID            string    `json:"vmId"`
+		TimeCreated     time.Time `json:"timeCreated"`
+		HardwareProfile struct {
+			VMSize string `json:"vmSize"`
+		} `json:"hardwareProfile"`
+		StorageProfile struct {
+			ImageReference struct {
+				ID        string `json:"id"`
+				Publisher string `json:"publisher"`
+				Offer     string `json:"offer"`
+				SKU       string `json:"sku"`
+				Version   string `json:"version"`
+			} `json:"imageReference"`
+			OSDisk struct {
+				OSType string `json:"osType"`
+			} `json:"osDisk"`
+		} `json:"storageProfile"`
+		NetworkProfile struct {
+			NetworkInterfaces []struct {
+				ID         string `json:"id"`
+				Properties struct {
+					Primary bool `json:"primary"`
+				} `json:"properties"`
+			} `json:"networkInterfaces"`
+		} `json:"networkProfile"`
+		InstanceView struct {
+			Statuses []struct {
+				Code string `json:"code"`
+			} `json:"statuses"`
+		} `json:"instanceView"`
+	} `json:"properties"`
+}
+
+type azureNIC struct {
+	ID         string `json:"id"`
+	Properties struct {
+		IPConfigurations []struct {
+			Properties struct {
+				Primary          bool   `json:"primary"`
+				PrivateIPAddress string `json:"privateIPAddress"`
+				PublicIPAddress  struct {
+					ID string `json:"id"`
+				} `json:"publicIPAddress"`
+				Subnet struct {
+					ID string `json:"id"`
+				} `json:"subnet"`
+			} `json:"properties"`
+		} `json:"ipConfigurations"`
+	} `json:"properties"`
+}
+
+type azurePublicIP struct {
+	ID         string `json:"id"`
+	Properties struct {
+		IPAddress string `json:"ipAddress"`
+	} `json:"properties"`
+}
+
+func (a *Azure) Discover(ctx context.Context) ([]Instance, []ScopeResult) {
+	slog.DebugContext(ctx, "Getting Azure instances.")
+	instances := make([]Instance, 0)
+	results := make([]ScopeResult, 0)
+
+	var loginErr error
+	if len(a.config.Azure.Accounts) > 0 {
+		loginErr = a.refreshToken(ctx, false)
+	}
+
+	// VM locations are lower case, whatever case the settings use.
+	regions := make([]string, 0)
+	for _, name := range sortedKeys(a.config.Azure.Regions) {
+		location := strings.ToLower(name)
+		if a.Selection.Region(name, a.config.Azure.Regions[name].Short) && !slices.Contains(regions, location) {
+			regions = append(regions, location)
+		}
+	}
+	// Without configured regions, selected ones are taken as locations.
+	whole := len(a.config.Azure.Regions) == 0 && len(a.Selection.Regions) == 0
+	if len(a.config.Azure.Regions) == 0 {
+		for _, name := range a.Selection.Regions {
+			regions = append(regions, strings.ToLower(name))
+		}
+	}
+	for _, account := range sortedKeys(a.config.Azure.Accounts) {
+		settings := a.config.Azure.Accounts[account]
+		if !a.Selection.Account(account, settings.Id, settings.Name) || !a.Selection.Env(settings.Env) {
+			continue
+		}
+		if !whole && len(regions) == 0 {
+			slog.WarnContext(ctx, "No region to scan", "account", account, "regions", strings.Join(a.Selection.Regions, ","))
+			continue
+		}
+		// The subscription is listed once and split into its regions, so
+		// VMs outside the configured regions are never counted as gone.
+		var vms []Instance
+		var scanErr error
+		scanned := false
+		scan := func(ctx context.Context) ([]Instance, error) {
+			if !scanned {
+				scanned = true
+				slog.InfoContext(ctx, "Checking Azure subscription", "subscription", settings.Id)
+				if loginErr != nil {
+					scanErr = loginErr
+				} else {
+					vms, scanErr = a.scan(ctx, account, settings.Id)
+				}
+			}
+			return vms, scanErr
+		}
+		if whole {
+			found, result := scanScope(ctx, Scope{Provider: a.Name(), Account: account}, scan)
+			instances = append(instances, found...)
+			results = append(results, result)
+			continue
+		}
+		for _, region := range regions {
+			scope := Scope{Provider: a.Name(), Account: account, Region: region}
+			found, result := scanScope(ctx, scope, func(ctx context.Context) ([]Instance, error) {
+				all, err := scan(ctx)
+				if err != nil {
+					return nil, err
+				}
+				inRegion := make([]Instance, 0)
+				for _, instance := range all {
+					if instance.Region == region {
+						inRegion = append(inRegion, instance)
+					}
+				}
+				return inRegion, nil
+			})
+			instances = append(instances, found...)
+			results = append(results, result)
+		}
+	}
+	return instances, results
+}
+
+// scan lists the VMs of one subscription along with their network details.
+func (a *Azure) scan(ctx context.Context, account string, subscription string) ([]Instance, error) {
+	instances := make([]Instance, 0)
+	vms, err := a.listVMs(ctx, subscription)
+	if err != nil {
+		return instances, fmt.Errorf("unable to list VMs: %w", err)
+	}
+	statuses, err := a.listVMStatuses(ctx, subscription)
+	if err != nil {
+		return instances, fmt.Errorf("unable to list VM statuses: %w", err)
+	}
+	nics, err := a.listNICs(ctx, subscription)
+	if err != nil {
+		return instances, fmt.Errorf("unable to list network interfaces: %w", err)
+	}
+	publicIPs, err := a.listPublicIPs(ctx, subscription)
+	if err != nil {
+		return instances, fmt.Errorf("unable to list public IPs: %w", err)
+	}
+	for _, vm := range vms {
+		if status, ok := statuses[strings.ToLower(vm.ID)]; ok {
+			vm.Properties.InstanceView = status.Properties.InstanceView
+		}
+		instance := TranslateAzureVM(vm, nics, publicIPs)
+		instance.Account = account
+		instance.ENV = a.config.Azure.Accounts[account].Env
+		slog.DebugContext(ctx, "Found Azure VM", "name", instance.Name, "instance", instance.ID)
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// TranslateAzureVM maps a VM and its primary NIC onto an Instance.  The NIC
+// and public IP maps are keyed by lower-cased resource ID.
+func TranslateAzureVM(vm azureVM, nics map[string]azureNIC, publicIPs map[string]azurePublicIP) Instance {
+	p := vm.Properties
+	image := p.StorageProfile.ImageReference
+	ami := image.ID
+	if ami == "" && image.Publisher != "" {
+		ami = strings.Join([]string{image.Publisher, image.Offer, image.SKU, image.Version}, ":")
+	}
+	tags := vm.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	name := vm.Name
+	if tag, ok := tags["Name"]; ok && tag != "" {
+		name = tag
+	}
+
+	i := Instance{
+		AMI:           ami,
+		CloudProvider: "azure",
+		ID:            p.VMID,
+		LaunchTime:    p.TimeCreated,
+		Name:          name,
+		OS:            p.StorageProfile.OSDisk.OSType,
+		Region:        vm.Location,
+		Size:          p.HardwareProfile.VMSize,
+		State:         azurePowerState(vm),
+		Tags:          tags,
+	}
+	if i.ID == "" {
+		i.ID = vm.ID
+	}
+
+	for _, ref := range p.NetworkProfile.NetworkInterfaces {
+		if len(p.NetworkProfile.NetworkInterfaces) > 1 && !ref.Properties.Primary {
+			continue
+		}
+		nic, ok := nics[strings.ToLower(ref.ID)]
+		if !ok {
+			continue
+		}
+		for _, ipc := range nic.Properties.IPConfigurations {
+			if len(nic.Properties.IPConfigurations) > 1 && !ipc.Properties.Primary {
+				continue
+			}
+			i.PrivateIP = ipc.Properties.PrivateIPAddress
+			if pip, ok := publicIPs[strings.ToLower(ipc.Properties.PublicIPAddress.ID)]; ok {
+				i.PublicIP = pip.Properties.IPAddress
+			}
+			// .../virtualNetworks/<vnet>/subnets/<subnet>
+			parts := strings.Split(ipc.Properties.Subnet.ID, "/")
+			if len(parts) >= 3 {
+				i.Subnet = parts[len(parts)-1]
+				i.VPC = parts[len(parts)-3]
+			}
+		}
+		break
+	}
+	return i
+}
+
+// azurePowerState turns "PowerState/running" and friends into the state names
+// EC2 uses where they overlap.
+func azurePowerState(vm azureVM) string {
+	for _, status := range vm.Properties.InstanceView.Statuses {
+		state, ok := strings.CutPrefix(status.Code, "PowerState/")
+		if !ok {
+			continue
+		}
+		switch state {
+		case "deallocated", "deallocating":
+			return "stopped"
+		case "starting":
+			return "pending"
+		}
+		return state
+	}
+	return "unknown"
+}
+
+// refreshToken logs in when there is no token, when it is about to expire,
+// or with force after ARM rejected it.  A token from AZURE_ACCESS_TOKEN is
+// kept unless there are client credentials to replace it with.
+func (a *Azure) refreshToken(ctx context.Context, force bool) error {
+	if !force && a.Token != "" && (a.Expires.IsZero() || time.Until(a.Expires) > azureTokenMargin) {
+		return nil
+	}
+	token, expiresIn, err := a.login(ctx)
+	if errors.Is(err, errNoAzureCredentials) && a.Token != "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.Token = token
+	a.Expires = time.Now().Add(expiresIn)
+	return nil
+}
+
+func (a *Azure) login(ctx context.Context) (string, time.Duration, error) {
+	tenant := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	secret := os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant == "" || clientID == "" || secret == "" {
+		return "", 0, errNoAzureCredentials
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {secret},
+		"scope":         {azureManagementURL + "/.default"},
+	}
+	link := a.LoginURL + "/" + url.PathEscape(tenant) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, link, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", 0, fmt.Errorf("azure login: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// getJSON fetches one ARM page.  A rejected token is replaced once.
+func (a *Azure) getJSON(ctx context.Context, link string, v any) error {
+	resp, err := a.get(ctx, link)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		if err := a.refreshToken(ctx, true); err != nil {
+			return err
+		}
+		resp, err = a.get(ctx, link)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", link, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a *Azure) get(ctx context.Context, link string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	req.Header.Set("Accept", "application/json")
+	return a.Client.Do(req)
+}
+
+// listAll follows nextLink until the collection is exhausted.
+func listAll[T any](ctx context.Context, a *Azure, link string) ([]T, error) {
+	items := make([]T, 0)
+	for link != "" {
+		var page azureList[T]
+		if err := a.getJSON(ctx, link, &page); err != nil {
+			return items, err
+		}
+		items = append(items, page.Value...)
+		link = page.NextLink
+	}
+	return items, nil
+}
+
+func (a *Azure) subscriptionURL(subscription string, provider string, apiVersion string, extra string) string {
+	return fmt.Sprintf("%s/subscriptions/%s/providers/%s?api-version=%s%s",
+		a.BaseURL, url.PathEscape(subscription), provider, apiVersion, extra)
+}
+
+func (a *Azure) listVMs(ctx context.Context, subscription string) ([]azureVM, error) {
+	link := a.subscriptionURL(subscription, "Microsoft.Compute/virtualMachines", azureComputeAPI, "")
+	return listAll[azureVM](ctx, a, link)
+}
+
+// listVMStatuses lists the instance views, which hold the power state, keyed
+// by lower-cased resource ID.  With statusOnly ARM leaves out the rest of the
+// model, so the VMs themselves come from listVMs.
+func (a *Azure) listVMStatuses(ctx context.Context, subscription string) (map[string]azureVM, error) {
+	link := a.subscriptionURL(subscription, "Microsoft.Compute/virtualMachines", azureComputeAPI, "&statusOnly=true")
+	vms, err := listAll[azureVM](ctx, a, link)
+	byID := make(map[string]azureVM)
+	for _, vm := range vms {
+		byID[strings.ToLower(vm.ID)] = vm
+	}
+	return byID, err
+}
+
+func (a *Azure) listNICs(ctx context.Context, subscription string) (map[string]azureNIC, error) {
+	link := a.subscriptionURL(subscription, "Microsoft.Network/networkInterfaces", azureNetworkAPI, "")
+	nics, err := listAll[azureNIC](ctx, a, link)
+	byID := make(map[string]azureNIC)
+	for _, nic := range nics {
+		byID[strings.ToLower(nic.ID)] = nic
+	}
+	return byID, err
+}
+
+func (a *Azure) listPublicIPs(ctx context.Context, subscription string) (map[string]azurePublicIP, error) {
+	link := a.subscriptionURL(subscription, "Microsoft.Network/publicIPAddresses", azureNetworkAPI, "")
+	ips, err := listAll[azurePublicIP](ctx, a, link)
+	byID := make(map[string]azurePublicIP)
+	for _, ip := range ips {
+		byID[strings.ToLower(ip.ID)] = ip
+	}
+	return byID, err
+}
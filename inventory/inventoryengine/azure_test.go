@@ -0,0 +1,421 @@
+package inventoryengine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSubscription = "00000000-0000-0000-0000-000000000001"
+
+// fakeARM stands in for the Azure token endpoint and the ARM list calls of
+// one subscription.
+type fakeARM struct {
+	*httptest.Server
+	mu sync.Mutex
+	// Tokens ARM accepts; login hands out the first.
+	tokens []string
+	// Status code for every ARM call instead of an answer, if set.
+	fail   int
+	logins int
+}
+
+func newFakeARM(t *testing.T) *fakeARM {
+	f := &fakeARM{tokens: []string{"token-1"}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	t.Setenv("AZURE_ACCESS_TOKEN", "")
+	t.Setenv("AZURE_TENANT_ID", "tenant")
+	t.Setenv("AZURE_CLIENT_ID", "client")
+	t.Setenv("AZURE_CLIENT_SECRET", "secret")
+	return f
+}
+
+func (f *fakeARM) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/tenant/oauth2/v2.0/token" {
+		r.ParseForm()
+		if r.Method != http.MethodPost || r.Form.Get("client_secret") != "secret" || r.Form.Get("grant_type") != "client_credentials" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		f.logins++
+		fmt.Fprintf(w, `{"token_type":"Bearer","expires_in":3599,"access_token":%q}`, f.tokens[0])
+		return
+	}
+
+	accepted := false
+	for _, token := range f.tokens {
+		accepted = accepted || r.Header.Get("Authorization") == "Bearer "+token
+	}
+	if !accepted {
+		http.Error(w, `{"error":{"code":"ExpiredAuthenticationToken"}}`, http.StatusUnauthorized)
+		return
+	}
+	if f.fail != 0 {
+		http.Error(w, `{"error":{"code":"InternalServerError"}}`, f.fail)
+		return
+	}
+
+	prefix := "/subscriptions/" + testSubscription + "/providers/"
+	switch {
+	case r.URL.Path == prefix+"Microsoft.Compute/virtualMachines" && r.URL.Query().Get("statusOnly") == "true":
+		fmt.Fprint(w, testVMStatuses)
+	case r.URL.Path == prefix+"Microsoft.Compute/virtualMachines" && r.URL.Query().Get("page") == "2":
+		fmt.Fprint(w, testVMsPage2)
+	case r.URL.Path == prefix+"Microsoft.Compute/virtualMachines":
+		fmt.Fprint(w, strings.ReplaceAll(testVMsPage1, "NEXT", f.URL+r.URL.Path+"?api-version="+azureComputeAPI+"&page=2"))
+	case r.URL.Path == prefix+"Microsoft.Network/networkInterfaces":
+		fmt.Fprint(w, testNICs)
+	case r.URL.Path == prefix+"Microsoft.Network/publicIPAddresses":
+		fmt.Fprint(w, testPublicIPs)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const testVMsPage1 = `{
+  "value": [
+    {
+      "name": "web01",
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/RG/providers/Microsoft.Compute/virtualMachines/web01",
+      "type": "Microsoft.Compute/virtualMachines",
+      "location": "eastus",
+      "tags": {"Name": "web-01", "team": "platform"},
+      "properties": {
+        "vmId": "11111111-aaaa-bbbb-cccc-000000000001",
+        "timeCreated": "2024-01-02T03:04:05Z",
+        "hardwareProfile": {"vmSize": "Standard_D2s_v5"},
+        "storageProfile": {
+          "imageReference": {"publisher": "Canonical", "offer": "0001-com-ubuntu-server-jammy", "sku": "22_04-lts-gen2", "version": "latest"},
+          "osDisk": {"osType": "Linux", "name": "web01_OsDisk"}
+        },
+        "networkProfile": {
+          "networkInterfaces": [
+            {"id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/web01-nic2", "properties": {"primary": false}},
+            {"id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/web01-nic", "properties": {"primary": true}}
+          ]
+        },
+        "provisioningState": "Succeeded"
+      }
+    }
+  ],
+  "nextLink": "NEXT"
+}`
+
+const testVMsPage2 = `{
+  "value": [
+    {
+      "name": "win01",
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/win01",
+      "location": "westeurope",
+      "properties": {
+        "vmId": "11111111-aaaa-bbbb-cccc-000000000002",
+        "hardwareProfile": {"vmSize": "Standard_B2ms"},
+        "storageProfile": {
+          "imageReference": {"id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/images/win2022"},
+          "osDisk": {"osType": "Windows"}
+        },
+        "networkProfile": {
+          "networkInterfaces": [
+            {"id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/win01-nic"}
+          ]
+        }
+      }
+    },
+    {
+      "name": "elsewhere01",
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/elsewhere01",
+      "location": "southindia",
+      "properties": {"vmId": "11111111-aaaa-bbbb-cccc-000000000003", "hardwareProfile": {"vmSize": "Standard_B1s"}}
+    }
+  ]
+}`
+
+// The shape of a statusOnly=true answer: the instance view and little else,
+// no hardware, storage or network profile.
+const testVMStatuses = `{
+  "value": [
+    {
+      "name": "web01",
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/web01",
+      "type": "Microsoft.Compute/virtualMachines",
+      "location": "eastus",
+      "properties": {
+        "instanceView": {
+          "statuses": [
+            {"code": "ProvisioningState/succeeded", "level": "Info", "displayStatus": "Provisioning succeeded"},
+            {"code": "PowerState/running", "level": "Info", "displayStatus": "VM running"}
+          ]
+        }
+      }
+    },
+    {
+      "name": "win01",
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/win01",
+      "type": "Microsoft.Compute/virtualMachines",
+      "location": "westeurope",
+      "properties": {
+        "instanceView": {
+          "statuses": [
+            {"code": "ProvisioningState/succeeded", "level": "Info"},
+            {"code": "PowerState/deallocated", "level": "Info", "displayStatus": "VM deallocated"}
+          ]
+        }
+      }
+    }
+  ]
+}`
+
+const testNICs = `{
+  "value": [
+    {
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/web01-nic",
+      "properties": {
+        "ipConfigurations": [
+          {"properties": {"primary": false, "privateIPAddress": "10.1.0.9"}},
+          {"properties": {
+            "primary": true,
+            "privateIPAddress": "10.1.0.4",
+            "publicIPAddress": {"id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/web01-ip"},
+            "subnet": {"id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/prod-vnet/subnets/web"}
+          }}
+        ]
+      }
+    },
+    {
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/web01-nic2",
+      "properties": {"ipConfigurations": [{"properties": {"privateIPAddress": "10.1.1.4"}}]}
+    },
+    {
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/networkInterfaces/win01-nic",
+      "properties": {"ipConfigurations": [{"properties": {"privateIPAddress": "10.2.0.5"}}]}
+    }
+  ]
+}`
+
+const testPublicIPs = `{
+  "value": [
+    {
+      "id": "/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/web01-ip",
+      "properties": {"ipAddress": "20.1.2.3"}
+    }
+  ]
+}`
+
+func newTestAzure(t *testing.T, f *fakeARM, regions string) *Azure {
+	c := testSettings(t, `
+azure:
+  accounts:
+    prod:
+      id: `+testSubscription+`
+      name: Production
+  regions: `+regions+`
+`)
+	a := NewAzure(c)
+	a.BaseURL = f.URL
+	a.LoginURL = f.URL
+	a.Client = f.Client()
+	return a
+}
+
+func TestTranslateAzureVM(t *testing.T) {
+	var page azureList[azureVM]
+	if err := json.Unmarshal([]byte(testVMsPage1), &page); err != nil {
+		t.Fatal(err)
+	}
+	var statuses azureList[azureVM]
+	if err := json.Unmarshal([]byte(testVMStatuses), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	var nics azureList[azureNIC]
+	if err := json.Unmarshal([]byte(testNICs), &nics); err != nil {
+		t.Fatal(err)
+	}
+	var ips azureList[azurePublicIP]
+	if err := json.Unmarshal([]byte(testPublicIPs), &ips); err != nil {
+		t.Fatal(err)
+	}
+	nicsByID := make(map[string]azureNIC)
+	for _, nic := range nics.Value {
+		nicsByID[strings.ToLower(nic.ID)] = nic
+	}
+	ipsByID := make(map[string]azurePublicIP)
+	for _, ip := range ips.Value {
+		ipsByID[strings.ToLower(ip.ID)] = ip
+	}
+
+	vm := page.Value[0]
+	if got := TranslateAzureVM(vm, nicsByID, ipsByID).State; got != "unknown" {
+		t.Errorf("state without an instance view = %q, want unknown", got)
+	}
+	vm.Properties.InstanceView = statuses.Value[0].Properties.InstanceView
+	i := TranslateAzureVM(vm, nicsByID, ipsByID)
+	want := Instance{
+		AMI:           "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest",
+		CloudProvider: "azure",
+		ID:            "11111111-aaaa-bbbb-cccc-000000000001",
+		LaunchTime:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Name:          "web-01",
+		OS:            "Linux",
+		PrivateIP:     "10.1.0.4",
+		PublicIP:      "20.1.2.3",
+		Region:        "eastus",
+		Size:          "Standard_D2s_v5",
+		State:         "running",
+		Subnet:        "web",
+		VPC:           "prod-vnet",
+	}
+	if i.Tags["team"] != "platform" {
+		t.Errorf("tags = %v", i.Tags)
+	}
+	i.Tags = nil
+	if !i.LaunchTime.Equal(want.LaunchTime) {
+		t.Errorf("launch time = %s, want %s", i.LaunchTime, want.LaunchTime)
+	}
+	i.LaunchTime = want.LaunchTime
+	if !reflect.DeepEqual(i, want) {
+		t.Errorf("instance =\n%+v\nwant\n%+v", i, want)
+	}
+
+	// A status-only answer has no profiles to translate.
+	bare := TranslateAzureVM(statuses.Value[0], nicsByID, ipsByID)
+	if bare.Size != "" || bare.OS != "" || bare.PrivateIP != "" {
+		t.Errorf("status-only VM = %+v", bare)
+	}
+}
+
+func TestAzureDiscover(t *testing.T) {
+	f := newFakeARM(t)
+	// Locations come back lower case.
+	a := newTestAzure(t, f, `{EastUS: {short: use}, westeurope: {short: weu}}`)
+
+	instances, results := a.Discover(context.Background())
+	if f.logins != 1 {
+		t.Errorf("logins = %d, want 1", f.logins)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %+v, want one per region", results)
+	}
+	for n, region := range []string{"eastus", "westeurope"} {
+		r := results[n]
+		if r.Err != nil || r.Scope != (Scope{Provider: "azure", Account: "prod", Region: region}) || r.Count != 1 {
+			t.Errorf("result %d = %+v", n, r)
+		}
+	}
+
+	byName := make(map[string]Instance)
+	for _, i := range instances {
+		byName[i.Name] = i
+	}
+	if len(instances) != 2 {
+		t.Errorf("instances = %+v, want web-01 and win01 only", instances)
+	}
+	web, win := byName["web-01"], byName["win01"]
+	if web.Account != "prod" || web.PrivateIP != "10.1.0.4" || web.PublicIP != "20.1.2.3" || web.Size != "Standard_D2s_v5" || web.OS != "Linux" || web.State != "running" {
+		t.Errorf("web-01 = %+v", web)
+	}
+	if win.PrivateIP != "10.2.0.5" || win.PublicIP != "" || win.OS != "Windows" || win.State != "stopped" || !strings.HasSuffix(win.AMI, "/images/win2022") {
+		t.Errorf("win01 = %+v", win)
+	}
+
+	// VMs outside the configured regions belong to no scope, so they can't
+	// be taken for terminated.
+	gone := Instance{CloudProvider: "azure", Account: "prod", Region: "southindia"}
+	for _, r := range results {
+		if r.Scope.Covers(gone) {
+			t.Errorf("%s covers southindia", r.Scope)
+		}
+	}
+}
+
+func TestAzureDiscoverWholeSubscription(t *testing.T) {
+	f := newFakeARM(t)
+	a := newTestAzure(t, f, `{}`)
+
+	instances, results := a.Discover(context.Background())
+	if len(results) != 1 || results[0].Scope.Region != "" || results[0].Count != 3 || len(instances) != 3 {
+		t.Errorf("results = %+v, %d instances", results, len(instances))
+	}
+}
+
+func TestAzureDiscoverSelection(t *testing.T) {
+	f := newFakeARM(t)
+	a := newTestAzure(t, f, `{eastus: {short: use}, westeurope: {short: weu}}`)
+	a.Selection = Selection{Regions: []string{"weu"}}
+	instances, results := a.Discover(context.Background())
+	if len(results) != 1 || results[0].Scope.Region != "westeurope" || len(instances) != 1 || instances[0].Name != "win01" {
+		t.Errorf("regions: results = %+v, instances = %+v", results, instances)
+	}
+
+	a.Selection = Selection{Envs: []string{"dev"}}
+	if instances, results := a.Discover(context.Background()); len(results) != 0 || len(instances) != 0 {
+		t.Errorf("other env: results = %+v, instances = %+v", results, instances)
+	}
+
+	// Without configured regions, selected regions are locations.
+	a = newTestAzure(t, f, `{}`)
+	a.config = testSettings(t, "azure: {accounts: {prod: {id: "+testSubscription+", env: prd}}}")
+	a.Selection = Selection{Regions: []string{"SouthIndia"}, Envs: []string{"PRD"}}
+	instances, results = a.Discover(context.Background())
+	if len(results) != 1 || results[0].Scope.Region != "southindia" || len(instances) != 1 || instances[0].ENV != "prd" {
+		t.Errorf("locations: results = %+v, instances = %+v", results, instances)
+	}
+}
+
+func TestAzureDiscoverErrors(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			f := newFakeARM(t)
+			f.fail = status
+			checkAzureFailure(t, newTestAzure(t, f, `{eastus: {}}`), fmt.Sprint(status))
+			// A 401 is worth one fresh token, not more.
+			if want := 1 + btoi(status == http.StatusUnauthorized); f.logins != want {
+				t.Errorf("logins = %d, want %d", f.logins, want)
+			}
+		})
+	}
+}
+
+func checkAzureFailure(t *testing.T, a *Azure, status string) {
+	t.Helper()
+	instances, results := a.Discover(context.Background())
+	if len(instances) != 0 || len(results) != 1 {
+		t.Fatalf("instances = %+v, results = %+v", instances, results)
+	}
+	if err := results[0].Err; err == nil || !strings.Contains(err.Error(), status) {
+		t.Errorf("err = %v, want a %s", err, status)
+	}
+}
+
+func TestAzureTokenRefresh(t *testing.T) {
+	f := newFakeARM(t)
+	a := newTestAzure(t, f, `{eastus: {}}`)
+
+	// A token about to expire is replaced before scanning.
+	a.Token, a.Expires = "old", time.Now().Add(time.Minute)
+	if _, results := a.Discover(context.Background()); results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	if f.logins != 1 || a.Token != "token-1" || time.Until(a.Expires) < 50*time.Minute {
+		t.Errorf("logins = %d, token %q expiring %s", f.logins, a.Token, a.Expires)
+	}
+
+	// One ARM no longer accepts is replaced on the 401.
+	f.tokens = []string{"token-2"}
+	if _, results := a.Discover(context.Background()); results[0].Err != nil {
+		t.Fatal(results[0].Err)
+	}
+	if f.logins != 2 || a.Token != "token-2" {
+		t.Errorf("logins = %d, token %q", f.logins, a.Token)
+	}
+}
@@ -0,0 +1,415 @@
+package inventoryengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// Default mapping of CMDB table fields to Instance fields.  Entries in the
+// cmdb settings named "map.<cmdb field>" add to or override it; an empty
+// value drops the field.
+var defaultCMDBFields = map[string]string{
+	"u_instance_id":    "id",
+	"name":             "name",
+	"ip_address":       "private_ip",
+	"u_public_ip":      "public_ip",
+	"os":               "os",
+	"u_cloud_provider": "cloud_provider",
+	"u_account":        "account",
+	"u_region":         "region",
+	"u_environment":    "env",
+	"u_size":           "size",
+	"u_state":          "state",
+	"u_owner":          "tag:Owner",
+}
+
+// CMDBTagPrefix marks tags pulled back from the CMDB.
+const CMDBTagPrefix = "cmdb:"
+
+// CMDB talks to a ServiceNow-style table API:
+//
+//	GET   {url}/api/now/table/{table}?{key_field}={id}
+//	POST  {url}/api/now/table/{table}
+//	PATCH {url}/api/now/table/{table}/{sys_id}
+//
+// Settings (all under "cmdb"): url, table, key_field, user, password or
+// password_env, token_env, pull_fields (comma separated) and map.<field>.
+type CMDB struct {
+	BaseURL    string
+	Table      string
+	KeyField   string
+	User       string
+	Password   string
+	Token      string
+	Fields     map[string]string
+	PullFields []string
+	Client     *http.Client
+}
+
+// CMDBChange is the outcome of syncing one instance.
+type CMDBChange struct {
+	ID      string               `yaml:"id" json:"id"`
+	Action  string               `yaml:"action" json:"action"`
+	SysID   string               `yaml:"sys_id" json:"sys_id"`
+	Changes map[string][2]string `yaml:"changes" json:"changes"`
+	Pulled  map[string]string    `yaml:"pulled" json:"pulled"`
+	Err     error                `yaml:"-" json:"-"`
+}
+
+func NewCMDB(c *config.Settings) (*CMDB, error) {
+	s := c.CMDB
+	if s["url"] == "" {
+		return nil, errors.New("cmdb.url is not set")
+	}
+	cmdb := &CMDB{
+		BaseURL:    strings.TrimRight(s["url"], "/"),
+		Table:      s["table"],
+		KeyField:   s["key_field"],
+		User:       s["user"],
+		Password:   s["password"],
+		Fields:     make(map[string]string),
+		PullFields: splitList(s["pull_fields"]),
+		Client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	if cmdb.Table == "" {
+		cmdb.Table = "cmdb_ci_server"
+	}
+	if cmdb.KeyField == "" {
+		cmdb.KeyField = "u_instance_id"
+	}
+	if _, ok := s["pull_fields"]; !ok {
+		cmdb.PullFields = []string{"business_service", "support_group"}
+	}
+	if env := s["password_env"]; env != "" {
+		cmdb.Password = os.Getenv(env)
+	}
+	if env := s["token_env"]; env != "" {
+		cmdb.Token = os.Getenv(env)
+	}
+
+	for k, v := range defaultCMDBFields {
+		cmdb.Fields[k] = v
+	}
+	for k, v := range s {
+		field, ok := strings.CutPrefix(k, "map.")
+		if !ok {
+			continue
+		}
+		if v == "" {
+			delete(cmdb.Fields, field)
+			continue
+		}
+		if FieldName(v) == "" {
+			return nil, fmt.Errorf("cmdb.%s: unknown instance field %q", k, v)
+		}
+		cmdb.Fields[field] = v
+	}
+	if _, ok := cmdb.Fields[cmdb.KeyField]; !ok {
+		cmdb.Fields[cmdb.KeyField] = "id"
+	}
+	return cmdb, nil
+}
+
+// Record returns the CMDB fields for an instance.
+func (cmdb *CMDB) Record(instance Instance) map[string]string {
+	record := make(map[string]string)
+	for field, name := range cmdb.Fields {
+		value, _ := FieldValue(instance, name)
+		record[field] = value
+	}
+	return record
+}
+
+func (cmdb *CMDB) tableURL() string {
+	return cmdb.BaseURL + "/api/now/table/" + url.PathEscape(cmdb.Table)
+}
+
+func (cmdb *CMDB) do(method string, link string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, link, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cmdb.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cmdb.Token)
+	} else if cmdb.User != "" {
+		req.SetBasicAuth(cmdb.User, cmdb.Password)
+	}
+
+	resp, err := cmdb.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, link, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Find returns the CMDB record for an instance ID, or nil if there is none.
+// The ID is matched as a plain field parameter rather than through
+// sysparm_query, where ^ and = in it would be read as query syntax.  Every
+// field comes back with both its raw and its display value.
+func (cmdb *CMDB) Find(id string) (map[string]any, error) {
+	query := url.Values{
+		cmdb.KeyField:           {id},
+		"sysparm_limit":         {"1"},
+		"sysparm_display_value": {"all"},
+	}
+	var result struct {
+		Result []map[string]any `json:"result"`
+	}
+	err := cmdb.do(http.MethodGet, cmdb.tableURL()+"?"+query.Encode(), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Result) == 0 {
+		return nil, nil
+	}
+	return result.Result[0], nil
+}
+
+// cmdbString flattens a record value to the raw value, which is what Sync
+// writes.  With sysparm_display_value=all fields come back as
+// {"display_value": ..., "value": ...}.
+func cmdbString(v any) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case map[string]any:
+		return cmdbString(value["value"])
+	}
+	return fmt.Sprint(v)
+}
+
+// cmdbDisplay is the display value of a record value, such as the name of a
+// referenced record rather than its sys_id.
+func cmdbDisplay(v any) string {
+	if value, ok := v.(map[string]any); ok {
+		if display := cmdbString(value["display_value"]); display != "" {
+			return display
+		}
+	}
+	return cmdbString(v)
+}
+
+// Sync makes the CMDB record of an instance match the inventory.  Only
+// changed fields are written, so running it twice changes nothing.  With
+// dryRun nothing is written at all.
+func (cmdb *CMDB) Sync(instance Instance, dryRun bool) CMDBChange {
+	change := CMDBChange{
+		ID:      instance.ID,
+		Changes: make(map[string][2]string),
+		Pulled:  make(map[string]string),
+	}
+	existing, err := cmdb.Find(instance.ID)
+	if err != nil {
+		change.Err = err
+		return change
+	}
+
+	desired := cmdb.Record(instance)
+	patch := make(map[string]string)
+	for field, value := range desired {
+		old := ""
+		if existing != nil {
+			old = cmdbString(existing[field])
+		}
+		if old != value {
+			patch[field] = value
+			change.Changes[field] = [2]string{old, value}
+		}
+	}
+
+	switch {
+	case existing == nil:
+		change.Action = "create"
+	case len(patch) == 0:
+		change.Action = "unchanged"
+		change.SysID = cmdbString(existing["sys_id"])
+	default:
+		change.Action = "update"
+		change.SysID = cmdbString(existing["sys_id"])
+	}
+	if existing != nil {
+		for _, field := range cmdb.PullFields {
+			if value := cmdbDisplay(existing[field]); value != "" {
+				change.Pulled[field] = value
+			}
+		}
+	}
+	if dryRun || change.Action == "unchanged" {
+		return change
+	}
+
+	var result struct {
+		Result map[string]any `json:"result"`
+	}
+	if change.Action == "create" {
+		change.Err = cmdb.do(http.MethodPost, cmdb.tableURL(), desired, &result)
+		if change.Err == nil {
+			change.SysID = cmdbString(result.Result["sys_id"])
+		}
+	} else {
+		change.Err = cmdb.do(http.MethodPatch, cmdb.tableURL()+"/"+url.PathEscape(change.SysID), patch, nil)
+	}
+	return change
+}
+
+// The CMDB section of the instance notes; the rest of the notes is left as
+// it was written.
+const (
+	cmdbNotesStart = "--- CMDB ---"
+	cmdbNotesEnd   = "--- end CMDB ---"
+)
+
+// splitCMDBNotes separates the CMDB section, markers included, from the
+// rest of the notes.
+func splitCMDBNotes(notes string) (string, string) {
+	start := strings.Index(notes, cmdbNotesStart)
+	if start < 0 {
+		return notes, ""
+	}
+	end := strings.Index(notes[start:], cmdbNotesEnd)
+	if end < 0 {
+		end = len(notes)
+	} else {
+		end += start + len(cmdbNotesEnd)
+	}
+	rest := strings.TrimRight(notes[:start], "\n") + notes[end:]
+	return strings.TrimSpace(rest), notes[start:end]
+}
+
+// withCMDBSection puts a CMDB section at the end of the notes in place of
+// the one they had.
+func withCMDBSection(notes string, section string) string {
+	rest, _ := splitCMDBNotes(notes)
+	switch {
+	case section == "":
+		return rest
+	case rest == "":
+		return section
+	}
+	return rest + "\n\n" + section
+}
+
+// CMDBNotes replaces the CMDB section of the notes with the pulled CI
+// fields, one per line.
+func CMDBNotes(notes string, pulled map[string]string) string {
+	if len(pulled) == 0 {
+		return withCMDBSection(notes, "")
+	}
+	lines := []string{cmdbNotesStart}
+	for _, k := range sortedKeys(pulled) {
+		lines = append(lines, k+": "+pulled[k])
+	}
+	lines = append(lines, cmdbNotesEnd)
+	return withCMDBSection(notes, strings.Join(lines, "\n"))
+}
+
+// SyncCMDB pushes every instance in the database to the CMDB.  With pull,
+// CI fields read back are stored as "cmdb:" tags and in a section of the
+// notes, leaving the rest of the notes alone.
+func (i *Inventory) SyncCMDB(dryRun bool, pull bool) ([]CMDBChange, error) {
+	cmdb, err := NewCMDB(i.Config())
+	if err != nil {
+		return nil, err
+	}
+	instances, err := i.db.ListAllInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]CMDBChange, 0, len(instances))
+	for _, instance := range instances {
+		change := cmdb.Sync(instance, dryRun)
+		if change.Err != nil {
+			slog.Error("CMDB sync failed", "instance", instance.ID, "err", change.Err)
+		} else if pull && !dryRun && len(change.Pulled) > 0 {
+			tags := make(map[string]string)
+			for k, v := range instance.Tags {
+				if !strings.HasPrefix(k, CMDBTagPrefix) {
+					tags[k] = v
+				}
+			}
+			for k, v := range change.Pulled {
+				tags[CMDBTagPrefix+k] = v
+			}
+			if err := i.db.SetTags(instance.ID, tags); err != nil {
+				return changes, err
+			}
+			if notes := CMDBNotes(instance.Notes, change.Pulled); notes != instance.Notes {
+				if err := i.db.SetNotes(instance.ID, notes); err != nil {
+					return changes, err
+				}
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// WriteCMDBChanges prints one line per created or updated record, with a
+// line per changed field.
+func WriteCMDBChanges(w io.Writer, changes []CMDBChange, verbose bool) {
+	counts := make(map[string]int)
+	for _, c := range changes {
+		if c.Err != nil {
+			counts["failed"]++
+			fmt.Fprintf(w, "! %s: %v\n", c.ID, c.Err)
+			continue
+		}
+		counts[c.Action]++
+		switch c.Action {
+		case "create":
+			fmt.Fprintf(w, "+ %s\n", c.ID)
+		case "update":
+			fmt.Fprintf(w, "~ %s (%s)\n", c.ID, c.SysID)
+		default:
+			if verbose {
+				fmt.Fprintf(w, "= %s (%s)\n", c.ID, c.SysID)
+			}
+			continue
+		}
+		fields := make([]string, 0, len(c.Changes))
+		for field := range c.Changes {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fmt.Fprintf(w, "    %s: %q -> %q\n", field, c.Changes[field][0], c.Changes[field][1])
+		}
+	}
+	fmt.Fprintf(w, "%d created, %d updated, %d unchanged, %d failed\n",
+		counts["create"], counts["update"], counts["unchanged"], counts["failed"])
+}
@@ -0,0 +1,248 @@
+package inventoryengine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTable stands in for a ServiceNow table API.  Records hold raw values;
+// fields listed in display read back with a different display value, the
+// way choice and reference fields do.
+type fakeTable struct {
+	*httptest.Server
+	mu      sync.Mutex
+	records []map[string]string
+	display map[string]map[string]string
+	writes  []string
+}
+
+func newFakeTable(t *testing.T) *fakeTable {
+	f := &fakeTable{display: map[string]map[string]string{
+		"u_environment": {"prd": "Production"},
+		"support_group": {"2f4e": "Linux Operations"},
+	}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTable) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const table = "/api/now/table/cmdb_ci_server"
+	if r.Header.Get("Authorization") != "Bearer secret-token" {
+		http.Error(w, `{"error":{"message":"User Not Authenticated"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == table:
+		q := r.URL.Query()
+		if q.Get("sysparm_display_value") != "all" || q.Has("sysparm_query") {
+			http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		result := make([]map[string]any, 0)
+		for _, record := range f.records {
+			if record["u_instance_id"] == q.Get("u_instance_id") {
+				fields := make(map[string]any)
+				for k, v := range record {
+					display := v
+					if d, ok := f.display[k][v]; ok {
+						display = d
+					}
+					fields[k] = map[string]any{"value": v, "display_value": display}
+				}
+				result = append(result, fields)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"result": result})
+	case r.Method == http.MethodPost && r.URL.Path == table:
+		record := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&record)
+		record["sys_id"] = fmt.Sprintf("sys%d", len(f.records)+1)
+		f.records = append(f.records, record)
+		f.writes = append(f.writes, "POST "+record["u_instance_id"])
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"result": record})
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, table+"/"):
+		sysID := strings.TrimPrefix(r.URL.Path, table+"/")
+		patch := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&patch)
+		for _, record := range f.records {
+			if record["sys_id"] == sysID {
+				for k, v := range patch {
+					record[k] = v
+				}
+				f.writes = append(f.writes, "PATCH "+sysID)
+				json.NewEncoder(w).Encode(map[string]any{"result": record})
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestCMDB(t *testing.T, f *fakeTable) *CMDB {
+	t.Setenv("TEST_CMDB_TOKEN", "secret-token")
+	c := testSettings(t, `
+cmdb:
+  url: `+f.URL+`/
+  token_env: TEST_CMDB_TOKEN
+  pull_fields: support_group
+`)
+	cmdb, err := NewCMDB(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmdb
+}
+
+// An ID with the characters sysparm_query would read as syntax.
+var testCMDBInstance = Instance{
+	ID:            "host^name=web1",
+	Name:          "web1",
+	CloudProvider: "static",
+	Account:       "colo",
+	ENV:           "prd",
+	PrivateIP:     "192.0.2.10",
+	State:         "running",
+	Tags:          map[string]string{"Owner": "platform"},
+}
+
+func TestCMDBSyncIdempotent(t *testing.T) {
+	f := newFakeTable(t)
+	cmdb := newTestCMDB(t, f)
+
+	change := cmdb.Sync(testCMDBInstance, false)
+	if change.Err != nil || change.Action != "create" || change.SysID != "sys1" {
+		t.Fatalf("first sync = %+v", change)
+	}
+	if got := f.records[0]; got["u_instance_id"] != testCMDBInstance.ID || got["u_environment"] != "prd" || got["u_owner"] != "platform" {
+		t.Errorf("created %v", got)
+	}
+
+	// Display values differ from the raw ones, but nothing changed.
+	change = cmdb.Sync(testCMDBInstance, false)
+	if change.Err != nil || change.Action != "unchanged" || len(change.Changes) != 0 {
+		t.Errorf("second sync = %+v", change)
+	}
+	if len(f.writes) != 1 {
+		t.Errorf("writes = %q, want only the create", f.writes)
+	}
+
+	moved := testCMDBInstance
+	moved.PrivateIP = "192.0.2.11"
+	change = cmdb.Sync(moved, false)
+	if change.Action != "update" || change.Changes["ip_address"] != [2]string{"192.0.2.10", "192.0.2.11"} || len(change.Changes) != 1 {
+		t.Errorf("update = %+v", change)
+	}
+	if f.records[0]["ip_address"] != "192.0.2.11" || len(f.writes) != 2 {
+		t.Errorf("records = %v, writes = %q", f.records, f.writes)
+	}
+}
+
+func TestCMDBSyncDryRun(t *testing.T) {
+	f := newFakeTable(t)
+	cmdb := newTestCMDB(t, f)
+
+	if change := cmdb.Sync(testCMDBInstance, true); change.Err != nil || change.Action != "create" {
+		t.Errorf("dry run create = %+v", change)
+	}
+	f.records = append(f.records, map[string]string{"sys_id": "sys9", "u_instance_id": testCMDBInstance.ID, "name": "old"})
+	if change := cmdb.Sync(testCMDBInstance, true); change.Err != nil || change.Action != "update" || change.Changes["name"] != [2]string{"old", "web1"} {
+		t.Errorf("dry run update = %+v", change)
+	}
+	if len(f.writes) != 0 {
+		t.Errorf("dry run wrote %q", f.writes)
+	}
+}
+
+func TestSyncCMDBPull(t *testing.T) {
+	f := newFakeTable(t)
+	t.Setenv("TEST_CMDB_TOKEN", "secret-token")
+	inv := testInventory(t, testSettings(t, `
+cmdb:
+  url: `+f.URL+`
+  token_env: TEST_CMDB_TOKEN
+  pull_fields: support_group
+`))
+	instance := testCMDBInstance
+	instance.Notes = "racked by hand"
+	if _, err := inv.db.UpsertInstances(context.Background(), []Instance{instance}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	f.records = append(f.records, map[string]string{"sys_id": "sys7", "u_instance_id": instance.ID, "support_group": "2f4e"})
+
+	changes, err := inv.SyncCMDB(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Pulled["support_group"] != "Linux Operations" {
+		t.Fatalf("changes = %+v", changes)
+	}
+	stored, _, err := inv.db.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Tags["cmdb:support_group"] != "Linux Operations" || stored.Tags["Owner"] != "platform" {
+		t.Errorf("tags = %v", stored.Tags)
+	}
+	want := "racked by hand\n\n--- CMDB ---\nsupport_group: Linux Operations\n--- end CMDB ---"
+	if stored.Notes != want {
+		t.Errorf("notes = %q, want %q", stored.Notes, want)
+	}
+
+	// The next scan keeps the pulled tags and notes, even with notes of
+	// its own.
+	instance.Notes = "moved to rack 4"
+	if _, err := inv.db.UpsertInstances(context.Background(), []Instance{instance}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	stored, _, _ = inv.db.GetInstance(instance.ID)
+	want = "moved to rack 4\n\n--- CMDB ---\nsupport_group: Linux Operations\n--- end CMDB ---"
+	if stored.Tags["cmdb:support_group"] != "Linux Operations" || stored.Notes != want {
+		t.Errorf("after upsert: tags = %v, notes = %q", stored.Tags, stored.Notes)
+	}
+
+	// A second pull replaces only the CMDB section.
+	f.mu.Lock()
+	f.records[0]["support_group"] = "dba"
+	f.mu.Unlock()
+	if _, err := inv.SyncCMDB(false, true); err != nil {
+		t.Fatal(err)
+	}
+	stored, _, _ = inv.db.GetInstance(instance.ID)
+	want = "moved to rack 4\n\n--- CMDB ---\nsupport_group: dba\n--- end CMDB ---"
+	if stored.Notes != want {
+		t.Errorf("after second pull: notes = %q, want %q", stored.Notes, want)
+	}
+}
+
+func TestCMDBNotes(t *testing.T) {
+	section := "--- CMDB ---\nowner: ops\n--- end CMDB ---"
+	tests := []struct {
+		notes  string
+		pulled map[string]string
+		want   string
+	}{
+		{"", map[string]string{"owner": "ops"}, section},
+		{"by hand", map[string]string{"owner": "ops"}, "by hand\n\n" + section},
+		{"before\n\n--- CMDB ---\nowner: dev\n--- end CMDB ---\nafter", map[string]string{"owner": "ops"}, "before\nafter\n\n" + section},
+		{"by hand\n\n" + section, nil, "by hand"},
+	}
+	for _, tt := range tests {
+		if got := CMDBNotes(tt.notes, tt.pulled); got != tt.want {
+			t.Errorf("CMDBNotes(%q) = %q, want %q", tt.notes, got, tt.want)
+		}
+	}
+}
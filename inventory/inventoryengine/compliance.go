@@ -0,0 +1,231 @@
+package inventoryengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// AgentCompliance is the security agent state of one instance, as found by
+// the last fact collection.
+type AgentCompliance struct {
+	ID              string    `yaml:"id" json:"id"`
+	Name            string    `yaml:"name" json:"name"`
+	Account         string    `yaml:"account" json:"account"`
+	Region          string    `yaml:"region" json:"region"`
+	Reachable       bool      `yaml:"reachable" json:"reachable"`
+	NotApplicable   bool      `yaml:"not_applicable" json:"not_applicable"`
+	FalconInstalled bool      `yaml:"falcon_installed" json:"falcon_installed"`
+	FalconRunning   bool      `yaml:"falcon_running" json:"falcon_running"`
+	FalconTagged    bool      `yaml:"falcon_tagged" json:"falcon_tagged"`
+	SplunkInstalled bool      `yaml:"splunk_installed" json:"splunk_installed"`
+	SplunkRunning   bool      `yaml:"splunk_running" json:"splunk_running"`
+	CollectedAt     time.Time `yaml:"collected_at" json:"collected_at"`
+	Problems        []string  `yaml:"problems" json:"problems"`
+}
+
+func (a AgentCompliance) Compliant() bool {
+	return a.NotApplicable || a.Reachable && len(a.Problems) == 0
+}
+
+// nonLinux are OS names the Linux agent checks don't apply to.
+var nonLinux = []string{"windows", "freebsd", "openbsd", "netbsd", "darwin", "macos", "solaris", "aix"}
+
+// agentsApply reports whether the falcon and splunk checks make sense for
+// an instance: a Linux host, or one not known to be anything else.  Only
+// the OS names of the instance and its facts, or a kernel other than
+// Linux, rule it out.
+func agentsApply(instance Instance, facts map[string]string) bool {
+	if kernel := facts["system.kernel_name"]; kernel != "" && !strings.EqualFold(kernel, "linux") {
+		return false
+	}
+	for _, os := range []string{instance.OS, facts["system.os.id"]} {
+		os = strings.ToLower(os)
+		for _, name := range nonLinux {
+			if strings.Contains(os, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AccountCompliance is one row of the compliance matrix.
+type AccountCompliance struct {
+	Account         string            `yaml:"account" json:"account"`
+	Instances       int               `yaml:"instances" json:"instances"`
+	NotApplicable   int               `yaml:"not_applicable" json:"not_applicable"`
+	Reachable       int               `yaml:"reachable" json:"reachable"`
+	FalconInstalled int               `yaml:"falcon_installed" json:"falcon_installed"`
+	FalconRunning   int               `yaml:"falcon_running" json:"falcon_running"`
+	FalconTagged    int               `yaml:"falcon_tagged" json:"falcon_tagged"`
+	SplunkInstalled int               `yaml:"splunk_installed" json:"splunk_installed"`
+	SplunkRunning   int               `yaml:"splunk_running" json:"splunk_running"`
+	Compliant       int               `yaml:"compliant" json:"compliant"`
+	Details         []AgentCompliance `yaml:"details" json:"details"`
+}
+
+// CheckAgents evaluates the stored facts of an instance against the falcon-env
+// and splunk_dir settings of its account.  Without facts the instance counts
+// as unreachable.  Windows and other non-Linux hosts are not applicable; a
+// host whose facts name no OS at all is flagged rather than left out.
+func CheckAgents(c *config.Settings, instance Instance, facts map[string]string, collectedAt time.Time) AgentCompliance {
+	result := AgentCompliance{
+		ID:          instance.ID,
+		Name:        instance.Name,
+		Account:     instance.Account,
+		Region:      instance.Region,
+		CollectedAt: collectedAt,
+		Problems:    make([]string, 0),
+	}
+	if !agentsApply(instance, facts) {
+		result.NotApplicable = true
+		return result
+	}
+	if len(facts) == 0 {
+		result.Problems = append(result.Problems, "unreachable")
+		return result
+	}
+	result.Reachable = true
+	if facts["system.os.id"] == "" && facts["system.kernel_name"] == "" {
+		result.Problems = append(result.Problems, "OS unknown")
+	}
+	result.FalconInstalled = facts["agents.falcon.installed"] == "true"
+	result.FalconRunning = facts["agents.falcon.running"] == "true"
+	result.SplunkInstalled = facts["agents.splunk.installed"] == "true"
+	result.SplunkRunning = facts["agents.splunk.running"] == "true"
+
+	expected := c.AWS.Accounts[instance.Account].FalconEnv
+	tags, tagsKnown := facts["agents.falcon.tags"]
+	if expected == "" {
+		result.FalconTagged = true
+	} else if tagsKnown {
+		result.FalconTagged = slices.Contains(strings.Split(tags, ","), expected)
+	}
+
+	if !result.FalconInstalled {
+		result.Problems = append(result.Problems, "falcon not installed")
+	} else if !result.FalconRunning {
+		result.Problems = append(result.Problems, "falcon not running")
+	}
+	if result.FalconInstalled && !result.FalconTagged {
+		if tagsKnown {
+			result.Problems = append(result.Problems, fmt.Sprintf("falcon not tagged %s", expected))
+		} else {
+			result.Problems = append(result.Problems, "falcon tags unknown")
+		}
+	}
+	if !result.SplunkInstalled {
+		result.Problems = append(result.Problems, fmt.Sprintf("splunk not in %s", facts["agents.splunk.dir"]))
+	} else if !result.SplunkRunning {
+		result.Problems = append(result.Problems, "splunk not running")
+	}
+	return result
+}
+
+// ComplianceReport builds the per-account compliance matrix from the
+// instances and facts in the database.
+func (i *Inventory) ComplianceReport() ([]AccountCompliance, error) {
+	c := i.Config()
+	instances, err := i.db.ListInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make(map[string]*AccountCompliance)
+	for _, instance := range instances {
+		if instance.State != "running" {
+			continue
+		}
+		facts, collectedAt, err := i.db.GetFacts(instance.ID)
+		if err != nil {
+			return nil, err
+		}
+		result := CheckAgents(c, instance, facts, collectedAt)
+
+		row, ok := accounts[instance.Account]
+		if !ok {
+			row = &AccountCompliance{Account: instance.Account}
+			accounts[instance.Account] = row
+		}
+		if result.NotApplicable {
+			row.NotApplicable++
+			continue
+		}
+		row.Instances++
+		row.Details = append(row.Details, result)
+		if !result.Reachable {
+			continue
+		}
+		row.Reachable++
+		row.FalconInstalled += btoi(result.FalconInstalled)
+		row.FalconRunning += btoi(result.FalconRunning)
+		row.FalconTagged += btoi(result.FalconTagged)
+		row.SplunkInstalled += btoi(result.SplunkInstalled)
+		row.SplunkRunning += btoi(result.SplunkRunning)
+		row.Compliant += btoi(result.Compliant())
+	}
+
+	matrix := make([]AccountCompliance, 0, len(accounts))
+	for _, row := range accounts {
+		matrix = append(matrix, *row)
+	}
+	sort.Slice(matrix, func(a, b int) bool { return matrix[a].Account < matrix[b].Account })
+	return matrix, nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteComplianceReport renders the matrix as "table" or "json".  With
+// details the table also lists every non-compliant instance.
+func WriteComplianceReport(w io.Writer, matrix []AccountCompliance, format string, details bool) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(matrix)
+	case "table", "":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tINSTANCES\tN/A\tREACHABLE\tFALCON\tRUNNING\tTAGGED\tSPLUNK\tRUNNING\tCOMPLIANT")
+	for _, row := range matrix {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			row.Account, row.Instances, row.NotApplicable, row.Reachable,
+			row.FalconInstalled, row.FalconRunning, row.FalconTagged,
+			row.SplunkInstalled, row.SplunkRunning, row.Compliant)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if !details {
+		return nil
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tID\tNAME\tPROBLEMS")
+	for _, row := range matrix {
+		for _, d := range row.Details {
+			if d.Compliant() {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Account, d.ID, d.Name, strings.Join(d.Problems, "; "))
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,51 @@
+package inventoryengine
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCheckAgentsApplicability(t *testing.T) {
+	c := testSettings(t, "{}")
+	agents := map[string]string{
+		"agents.falcon.installed": "true",
+		"agents.falcon.running":   "true",
+		"agents.splunk.installed": "true",
+		"agents.splunk.running":   "true",
+	}
+	with := func(facts map[string]string) map[string]string {
+		merged := make(map[string]string)
+		for k, v := range agents {
+			merged[k] = v
+		}
+		for k, v := range facts {
+			merged[k] = v
+		}
+		return merged
+	}
+	tests := []struct {
+		name          string
+		os            string
+		facts         map[string]string
+		notApplicable bool
+		compliant     bool
+		problems      []string
+	}{
+		{"linux", "Linux", with(map[string]string{"system.os.id": "ubuntu", "system.kernel_name": "Linux"}), false, true, []string{}},
+		{"windows by cloud", "Windows", nil, true, true, []string{}},
+		{"freebsd by kernel", "", with(map[string]string{"system.kernel_name": "FreeBSD"}), true, true, []string{}},
+		{"freebsd by os-release", "", with(map[string]string{"system.os.id": "freebsd"}), true, true, []string{}},
+		{"linux without os-release", "Linux", with(map[string]string{"system.kernel_name": "Linux"}), false, true, []string{}},
+		{"unknown", "", with(map[string]string{"system.hostname": "db1"}), false, false, []string{"OS unknown"}},
+		{"unreachable", "", nil, false, false, []string{"unreachable"}},
+	}
+	for _, tt := range tests {
+		instance := Instance{ID: "i-1", Account: "prod", OS: tt.os, State: "running"}
+		result := CheckAgents(c, instance, tt.facts, time.Now())
+		if result.NotApplicable != tt.notApplicable || result.Compliant() != tt.compliant || !slices.Equal(result.Problems, tt.problems) {
+			t.Errorf("%s: not applicable %v, compliant %v, problems %q; want %v, %v, %q", tt.name,
+				result.NotApplicable, result.Compliant(), result.Problems, tt.notApplicable, tt.compliant, tt.problems)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package inventoryengine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// Reload reads the settings file again.  Providers are rebuilt from the new
+// settings on the next roll; on error the old settings stay in place.
+func (i *Inventory) Reload() error {
+	c, err := config.LoadConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+	old := i.config
+	i.config = c
+	if err := i.SetupLogging(); err != nil {
+		i.config = old
+		return err
+	}
+	i.providers = nil
+	return nil
+}
+
+// DaemonSchedule reads the interval and jitter settings.  The interval
+// defaults to an hour.
+func DaemonSchedule(c *config.Settings) (time.Duration, time.Duration, error) {
+	interval, jitter := time.Hour, time.Duration(0)
+	var err error
+	if value := c.Inventory.Interval; value != "" {
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("bad inventory.interval %q", value)
+		}
+	}
+	if value := c.Inventory.Jitter; value != "" {
+		if jitter, err = time.ParseDuration(value); err != nil || jitter < 0 {
+			return 0, 0, fmt.Errorf("bad inventory.jitter %q", value)
+		}
+	}
+	return interval, jitter, nil
+}
+
+func nextRoll(interval time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// Daemon rolls straight away and then every interval plus a random share of
+// jitter, until SIGTERM or SIGINT.  A signal during a roll lets it finish
+// first; a second one stops it early, keeping what it found.  SIGHUP
+// reloads the settings before the next roll, and with them the schedule
+// unless it was fixed by the caller (zero interval).
+func (i *Inventory) Daemon(interval time.Duration, jitter time.Duration) error {
+	fixed := interval > 0
+	if !fixed {
+		var err error
+		if interval, jitter, err = DaemonSchedule(i.Config()); err != nil {
+			return err
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	done := make(chan error, 1)
+	rolling, stopping, reload := false, false, false
+	for {
+		select {
+		case <-timer.C:
+			rolling = true
+			go func() { done <- i.Roll(ctx) }()
+
+		case err := <-done:
+			rolling = false
+			if err != nil {
+				slog.Error("Roll failed", "err", err)
+			}
+			if stopping {
+				slog.Info("Stopped.")
+				return nil
+			}
+			if reload {
+				reload = false
+				if err := i.reload(fixed, &interval, &jitter); err != nil {
+					slog.Error("Reload failed, keeping the old settings", "err", err)
+				}
+			}
+			next := nextRoll(interval, jitter)
+			slog.Info("Next roll scheduled", "in", next.Round(time.Second))
+			timer.Reset(next)
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if rolling {
+					slog.Info("Reloading settings after this roll.")
+					reload = true
+				} else if err := i.reload(fixed, &interval, &jitter); err != nil {
+					slog.Error("Reload failed, keeping the old settings", "err", err)
+				}
+				continue
+			}
+			if !rolling {
+				slog.Info("Stopped.")
+				return nil
+			}
+			if stopping {
+				slog.Info("Stopping the roll early.", "signal", sig.String())
+				cancel()
+				continue
+			}
+			slog.Info("Stopping after this roll.", "signal", sig.String())
+			stopping = true
+		}
+	}
+}
+
+func (i *Inventory) reload(fixed bool, interval *time.Duration, jitter *time.Duration) error {
+	old := i.config
+	if err := i.Reload(); err != nil {
+		return err
+	}
+	if !fixed {
+		newInterval, newJitter, err := DaemonSchedule(i.Config())
+		if err != nil {
+			i.config = old
+			return err
+		}
+		*interval, *jitter = newInterval, newJitter
+	}
+	slog.Info("Settings reloaded.")
+	return nil
+}
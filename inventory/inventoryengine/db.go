@@ -1,48 +1,73 @@
 package inventoryengine
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
+	"net/url"
 
 	// "github.com/aws/smithy-go/logging"
 	_ "github.com/mattn/go-sqlite3"
 
 	// "log"
 	"errors"
+	"strings"
 	"time"
 )
 
 type DB struct {
 	dbFilename string
 	db *sql.DB
+	// The run history is written for, see StartRun.
+	run int64
 }
 
 func NewDB() *DB {
-	instance := &DB{dbFilename: "inventory.db"}
+	return OpenDB("inventory.db")
+}
+
+// OpenDB opens an inventory database, creating or migrating it as needed.
+func OpenDB(filename string) *DB {
+	instance := &DB{dbFilename: filename}
 	instance.Init()
 	return instance
 }
 
-func (db *DB) Init() error {
-	log.Debug("Database Init")
-	var err error
-	db.db, err = sql.Open("sqlite3", db.dbFilename)
+// OpenSnapshot opens a backup, or any other inventory database, read-only
+// and as it is.
+func OpenSnapshot(filename string) (*DB, error) {
+	uri := &url.URL{Scheme: "file", Path: filename, RawQuery: "mode=ro"}
+	sqldb, err := sql.Open("sqlite3", uri.String())
 	if err != nil {
-		LogAndQuit("Unable to open database file", errors.New(db.dbFilename))
+		return nil, err
 	}
-
-	tx, err := db.db.Begin()
-	if err != nil {
-		LogAndQuit("Initializing DB", err)
+	var n int
+	if err := sqldb.QueryRow("SELECT COUNT(*) FROM AWSInstance").Scan(&n); err != nil {
+		sqldb.Close()
+		return nil, fmt.Errorf("%s is not an inventory database: %w", filename, err)
 	}
+	return &DB{dbFilename: filename, db: sqldb}, nil
+}
 
-	stmt := `
+// Backup writes a consistent copy of the database to a new file.
+func (db *DB) Backup(filename string) error {
+	_, err := db.db.Exec("VACUUM INTO ?", filename)
+	return err
+}
+
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+const instanceSchema = `
 	CREATE TABLE IF NOT EXISTS
-		AWSInstance (
+		%s (
 			Account TEXT,
 			AMI TEXT,
+			CloudProvider TEXT,
 			ENV TEXT,
-			ID TEXT,
+			ID TEXT PRIMARY KEY,
 			KeypairName TEXT,
 			LaunchTime DATETIME,
 			Name TEXT,
@@ -59,14 +84,55 @@ func (db *DB) Init() error {
 			Subnet TEXT,
 			User TEXT,
 			VPC TEXT,
-			LastSeen DATETIME
+			FirstSeen DATETIME,
+			LastSeen DATETIME,
+			TerminatedAt DATETIME
 		)`
-	_, err = tx.Exec(stmt)
+
+func (db *DB) Init() error {
+	slog.Debug("Database Init", "file", db.dbFilename)
+	var err error
+	// Wait for a lock rather than failing straight away if another process
+	// is writing.
+	db.db, err = sql.Open("sqlite3", db.dbFilename+"?_busy_timeout=10000")
+	if err != nil {
+		LogAndQuit("Unable to open database file", errors.New(db.dbFilename))
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		LogAndQuit("Initializing DB", err)
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(instanceSchema, "AWSInstance"))
 	if err != nil {
 		LogAndQuit("Unable to create table (Instance)", err)
 	}
 	
-	stmt = `
+	// Tables created by older versions lack these columns.
+	err = addColumnIfMissing(tx, "AWSInstance", "CloudProvider", "TEXT DEFAULT 'aws'")
+	if err != nil {
+		LogAndQuit("Unable to migrate table (Instance)", err)
+	}
+	err = addColumnIfMissing(tx, "AWSInstance", "TerminatedAt", "DATETIME")
+	if err != nil {
+		LogAndQuit("Unable to migrate table (Instance)", err)
+	}
+	err = addColumnIfMissing(tx, "AWSInstance", "FirstSeen", "DATETIME")
+	if err != nil {
+		LogAndQuit("Unable to migrate table (Instance)", err)
+	}
+	_, err = tx.Exec("UPDATE AWSInstance SET FirstSeen = LastSeen WHERE FirstSeen IS NULL")
+	if err != nil {
+		LogAndQuit("Unable to migrate table (Instance)", err)
+	}
+	// ...and have no primary key, which the upsert needs.
+	err = addPrimaryKeyIfMissing(tx)
+	if err != nil {
+		LogAndQuit("Unable to migrate table (Instance)", err)
+	}
+
+	stmt := `
 	CREATE TABLE IF NOT EXISTS
 		Tags (
 			InstanceID TEXT,
@@ -78,6 +144,31 @@ func (db *DB) Init() error {
 		LogAndQuit("Unable to create table (Tags)", err)
 	}
 
+	stmt = `
+	CREATE TABLE IF NOT EXISTS
+		Facts (
+			InstanceID TEXT,
+			Key TEXT,
+			Value TEXT,
+			CollectedAt DATETIME
+		)`
+	_, err = tx.Exec(stmt)
+	if err != nil {
+		LogAndQuit("Unable to create table (Facts)", err)
+	}
+
+	err = createHistoryTables(tx)
+	if err != nil {
+		LogAndQuit("Unable to create tables (Runs, History)", err)
+	}
+
+	for _, table := range []string{"Tags", "Facts"} {
+		err = addUniqueKeyIfMissing(tx, table, "InstanceID", "Key")
+		if err != nil {
+			LogAndQuit(fmt.Sprintf("Unable to migrate table (%s)", table), err)
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		LogAndQuit("Error committing initialization changes", err)
@@ -86,81 +177,254 @@ func (db *DB) Init() error {
 	return nil
 }
 
-func (db *DB) InstanceExists(i Instance) (bool) {
-	var count int
-
-	tx, err := db.db.Begin()
+// tableColumns maps the columns of a table to whether they are part of the
+// primary key.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	columns := make(map[string]bool)
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		LogAndQuit("Error checking for instance in DB", err)
+		return columns, err
 	}
+	defer rows.Close()
 
-	stmt := `
-	SELECT
-		count(*)
-	FROM
-		AWSInstance
-	WHERE
-		ID = ? AND
-		State != 'terminated'`
-	err = tx.QueryRow(stmt, i.ID, i.State).Scan(&count)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return columns, err
+		}
+		columns[name] = pk > 0
+	}
+	return columns, rows.Err()
+}
+
+func addColumnIfMissing(tx *sql.Tx, table string, column string, definition string) error {
+	columns, err := tableColumns(tx, table)
 	if err != nil {
-		LogAndQuit("Error pulling instance from DB", err)
+		return err
 	}
-	
-	return count > 0
+	if _, ok := columns[column]; ok {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
-func (db *DB) UpdateInstance(i Instance) {
-	tx, err := db.db.Begin()
+// addPrimaryKeyIfMissing rebuilds an old AWSInstance table with ID as the
+// primary key, keeping the most recently seen row of any duplicates.
+func addPrimaryKeyIfMissing(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "AWSInstance")
 	if err != nil {
-		LogAndQuit(fmt.Sprintf("Unable to update instance: %s", i.ID), err)
+		return err
 	}
-	defer tx.Commit()
+	if columns["ID"] {
+		return nil
+	}
+	slog.Info("Adding primary key to AWSInstance.")
 
-	stmt := `
-	UPDATE AWSInstance SET
-		ENV = ?,
-		Name = ?,
-		OS = ?,
-		PrivateIP = ?,
-		PublicIP = ?,
-		Size = ?,
-		Skip = ?,
-		SSHKey = ?,
-		SSHPort = ?,
-		State = ?,
-		Subnet = ?,
-		User = ?
-	WHERE
-		ID = ?`
-	tx.Exec(stmt, i.ENV, i.Name, i.OS, i.PrivateIP, i.PublicIP, i.Size, i.Skip, i.SSHKey, i.SSHPort, i.State, i.Subnet, i.User, i.ID)
+	stmts := []string{
+		"ALTER TABLE AWSInstance RENAME TO AWSInstanceOld",
+		fmt.Sprintf(instanceSchema, "AWSInstance"),
+		`INSERT INTO AWSInstance (` + instanceColumns + `)
+		SELECT ` + instanceColumns + ` FROM AWSInstanceOld o
+		WHERE o.ID IS NOT NULL AND o.rowid = (
+			SELECT x.rowid FROM AWSInstanceOld x WHERE x.ID = o.ID ORDER BY x.LastSeen DESC, x.rowid DESC LIMIT 1
+		)`,
+		"DROP TABLE AWSInstanceOld",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db *DB) FlagInstancesAsTerminated(needsMarked []string) error {
-	tx, err := db.db.Begin()
+// addUniqueKeyIfMissing dedupes a key/value table and indexes it so that each
+// instance has one value per key.
+func addUniqueKeyIfMissing(tx *sql.Tx, table string, columns ...string) error {
+	key := strings.Join(columns, ", ")
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE rowid NOT IN (SELECT MAX(rowid) FROM %s GROUP BY %s)", table, table, key)
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+	stmt = fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_%s ON %s (%s)", table, strings.Join(columns, ""), table, key)
+	_, err := tx.Exec(stmt)
+	return err
+}
+
+// UpsertInstances writes a whole scan in one transaction and returns the IDs
+// that weren't in the database before.  Logins, OS and notes found by other
+// means are kept when the scan has nothing for them, an OS named by facts
+// beats the cloud's OS type, and tags and notes pulled from the CMDB survive.
+// On any error, or if ctx is done first, nothing is written.
+func (db *DB) UpsertInstances(ctx context.Context, instances []Instance, seenAt time.Time) ([]string, error) {
+	slog.DebugContext(ctx, "Upserting instances", "count", len(instances))
+	newIDs := make([]string, 0)
+
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		LogAndQuit("Unable to flag instances as terminated", err)
+		return newIDs, err
 	}
-	defer tx.Commit()
-	for _, id := range needsMarked {
-		stmt := "UPDATE Instance SET State = 'terminated' WHERE ID = ?"
-		tx.Exec(stmt, id)
+	// Rollback after a successful Commit is a no-op.
+	defer tx.Rollback()
+
+	existing, err := tx.Prepare("SELECT " + instanceColumns + " FROM AWSInstance WHERE ID = ?")
+	if err != nil {
+		return newIDs, err
 	}
-	return nil
+	defer existing.Close()
+
+	hasFacts, err := tx.Prepare("SELECT 1 FROM Facts WHERE InstanceID = ? LIMIT 1")
+	if err != nil {
+		return newIDs, err
+	}
+	defer hasFacts.Close()
+
+	upsert, err := tx.Prepare(`
+	INSERT INTO AWSInstance (
+		Account, AMI, CloudProvider, ENV, ID, KeypairName, LaunchTime, Name, Notes, OS, PrivateIP, PublicIP,
+		Region, Size, Skip, SSHKey, SSHPort, State, Subnet, User, VPC, FirstSeen, LastSeen, TerminatedAt
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(ID) DO UPDATE SET
+		Account = excluded.Account,
+		AMI = excluded.AMI,
+		CloudProvider = excluded.CloudProvider,
+		ENV = excluded.ENV,
+		KeypairName = excluded.KeypairName,
+		LaunchTime = excluded.LaunchTime,
+		Name = excluded.Name,
+		Notes = COALESCE(NULLIF(excluded.Notes, ''), Notes),
+		OS = COALESCE(NULLIF(excluded.OS, ''), OS),
+		PrivateIP = excluded.PrivateIP,
+		PublicIP = excluded.PublicIP,
+		Region = excluded.Region,
+		Size = excluded.Size,
+		Skip = excluded.Skip,
+		SSHKey = COALESCE(NULLIF(excluded.SSHKey, ''), SSHKey),
+		SSHPort = COALESCE(NULLIF(excluded.SSHPort, ''), SSHPort),
+		State = excluded.State,
+		Subnet = excluded.Subnet,
+		User = COALESCE(NULLIF(excluded.User, ''), User),
+		VPC = excluded.VPC,
+		FirstSeen = COALESCE(FirstSeen, excluded.FirstSeen),
+		LastSeen = excluded.LastSeen,
+		TerminatedAt = CASE WHEN excluded.State = 'terminated' THEN COALESCE(TerminatedAt, excluded.TerminatedAt) END`)
+	if err != nil {
+		return newIDs, err
+	}
+	defer upsert.Close()
+
+	deleteTags, err := tx.Prepare("DELETE FROM Tags WHERE InstanceID = ? AND Key NOT LIKE '" + CMDBTagPrefix + "%'")
+	if err != nil {
+		return newIDs, err
+	}
+	defer deleteTags.Close()
+
+	insertTag, err := tx.Prepare("INSERT OR REPLACE INTO Tags (InstanceID, Key, Value) VALUES (?, ?, ?)")
+	if err != nil {
+		return newIDs, err
+	}
+	defer insertTag.Close()
+
+	for _, i := range instances {
+		old, err := scanInstance(existing.QueryRow(i.ID))
+		var history []HistoryEntry
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			newIDs = append(newIDs, i.ID)
+			history = []HistoryEntry{{InstanceID: i.ID, Event: "created"}}
+		case err != nil:
+			return newIDs, err
+		default:
+			if old.OS != "" && i.OS != old.OS {
+				var one int
+				switch err := hasFacts.QueryRow(i.ID).Scan(&one); {
+				case err == nil:
+					i.OS = old.OS
+				case !errors.Is(err, sql.ErrNoRows):
+					return newIDs, err
+				}
+			}
+			// Notes from a scan replace the old ones but for the section
+			// pulled from the CMDB.
+			if _, section := splitCMDBNotes(old.Notes); section != "" && i.Notes != "" {
+				i.Notes = withCMDBSection(i.Notes, section)
+			}
+			history = instanceChanges(old, i)
+		}
+		if err := db.addHistory(tx, history, seenAt); err != nil {
+			return newIDs, err
+		}
+
+		var terminatedAt any
+		if i.State == "terminated" {
+			terminatedAt = seenAt
+		}
+		_, err = upsert.Exec(
+			i.Account, i.AMI, i.CloudProvider, i.ENV, i.ID, i.KeypairName, i.LaunchTime, i.Name, i.Notes, i.OS, i.PrivateIP, i.PublicIP,
+			i.Region, i.Size, i.Skip, i.SSHKey, i.SSHPort, i.State, i.Subnet, i.User, i.VPC, seenAt, seenAt, terminatedAt,
+		)
+		if err != nil {
+			return newIDs, fmt.Errorf("unable to store %s: %w", i.ID, err)
+		}
+
+		if _, err := deleteTags.Exec(i.ID); err != nil {
+			return newIDs, err
+		}
+		for k, v := range i.Tags {
+			if _, err := insertTag.Exec(i.ID, k, v); err != nil {
+				return newIDs, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newIDs, err
+	}
+	return newIDs, nil
 }
 
-func (db *DB) GetActiveInstances() ([]string, error) {
-	log.Debug("Getting active instances.")
-	tx, err := db.db.Begin()
+// SetLogin records the login found by discovery.
+func (db *DB) SetLogin(ctx context.Context, ID string, user string, key string, port string) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE AWSInstance SET User = ?, SSHKey = ?, SSHPort = ? WHERE ID = ?", user, key, port, ID)
+	return err
+}
+
+func (db *DB) SetOS(ctx context.Context, ID string, os string) error {
+	_, err := db.db.ExecContext(ctx, "UPDATE AWSInstance SET OS = ? WHERE ID = ?", os, ID)
+	return err
+}
+
+// FlagInstancesAsTerminated marks instances terminated and records when we
+// noticed.  Either all of them are marked or none are.
+func (db *DB) FlagInstancesAsTerminated(ctx context.Context, needsMarked []string) error {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		return make([]string, 0), err
+		return err
+	}
+	now := time.Now()
+	stmt := "UPDATE AWSInstance SET State = 'terminated', TerminatedAt = ? WHERE ID = ?"
+	for _, id := range needsMarked {
+		_, err := tx.Exec(stmt, now, id)
+		if err == nil {
+			err = db.addHistory(tx, []HistoryEntry{{InstanceID: id, Event: "terminated"}}, now)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-	defer tx.Commit()
+	return tx.Commit()
+}
 
+func (db *DB) GetActiveInstances() ([]string, error) {
+	slog.Debug("Getting active instances.")
 	instances := make([]string, 0)
 	
-	stmt := `SELECT InstanceID FROM AWSInstance WHERE State != 'terminated'`
-	rows, err := tx.Query(stmt)
+	stmt := `SELECT ID FROM AWSInstance WHERE State != 'terminated'`
+	rows, err := db.db.Query(stmt)
 	if err != nil {
 		return make([]string, 0), err
 	}
@@ -170,99 +434,208 @@ func (db *DB) GetActiveInstances() ([]string, error) {
 		var id string
 		err := rows.Scan(&id)
 		if err != nil {
-			panic(err)
+			return make([]string, 0), err
 		}
 		instances = append(instances, id)
 	}
-	log.Debug("Got all active instances.")
-	return instances, nil
+	slog.Debug("Got all active instances.")
+	return instances, rows.Err()
+}
+
+const instanceColumns = `Account, AMI, CloudProvider, ENV, ID, KeypairName, LaunchTime, Name, Notes, OS, PrivateIP, PublicIP,
+		Region, Size, Skip, SSHKey, SSHPort, State, Subnet, User, VPC, FirstSeen, LastSeen, TerminatedAt`
+
+type rowScanner interface {
+	Scan(dest ...any) error
 }
 
-func (db *DB) AddInstancesToDB(instances map[string]Instance) {
-	log.Debug("Adding instances to DB.")
-	for instanceID, instance := range instances {
-		log.Debugf("Adding %s to db\n", instanceID)
-		db.AddOrUpdateInstance(instance)
+func scanInstance(row rowScanner) (Instance, error) {
+	var i Instance
+	var account, ami, provider, env, keypair, name, notes, os, privateIP, publicIP sql.NullString
+	var region, size, sshKey, sshPort, state, subnet, user, vpc sql.NullString
+	var launchTime, firstSeen, lastSeen, terminatedAt sql.NullTime
+	var skip sql.NullBool
+
+	err := row.Scan(
+		&account, &ami, &provider, &env, &i.ID, &keypair, &launchTime, &name, &notes, &os, &privateIP, &publicIP,
+		&region, &size, &skip, &sshKey, &sshPort, &state, &subnet, &user, &vpc, &firstSeen, &lastSeen, &terminatedAt,
+	)
+	if err != nil {
+		return i, err
 	}
+	i.Account, i.AMI, i.ENV, i.KeypairName = account.String, ami.String, env.String, keypair.String
+	i.LaunchTime, i.Name, i.Notes, i.OS = launchTime.Time, name.String, notes.String, os.String
+	i.PrivateIP, i.PublicIP, i.Region, i.Size = privateIP.String, publicIP.String, region.String, size.String
+	i.Skip, i.SSHKey, i.SSHPort, i.State = skip.Bool, sshKey.String, sshPort.String, state.String
+	i.Subnet, i.User, i.VPC = subnet.String, user.String, vpc.String
+	i.FirstSeen, i.LastSeen, i.TerminatedAt = firstSeen.Time, lastSeen.Time, terminatedAt.Time
+	i.CloudProvider = provider.String
+	i.Tags = make(map[string]string)
+	return i, nil
+}
+
+// ListInstances reads back every instance that isn't terminated, with tags.
+func (db *DB) ListInstances() ([]Instance, error) {
+	return db.listInstances("WHERE State != 'terminated'")
 }
 
-func (db *DB) AddOrUpdateInstance(i Instance) {
-	if db.InstanceExists(i) {
-		log.Debug("Updating.")
-		db.UpdateInstance(i)
-		log.Debug("Updated.")
-	} else {
-		log.Debug("Adding.")
-		db.AddInstance(i)
-		log.Debug("Added")
+// ListAllInstances includes terminated instances.
+func (db *DB) ListAllInstances() ([]Instance, error) {
+	return db.listInstances("")
+}
+
+// GetInstance reads one instance, with tags.  It returns false if there is
+// no such instance.
+func (db *DB) GetInstance(ID string) (Instance, bool, error) {
+	instances, err := db.listInstances("WHERE ID = ?", ID)
+	if err != nil || len(instances) == 0 {
+		return Instance{}, false, err
 	}
+	return instances[0], true, nil
 }
 
-func (db *DB) AddInstance(i Instance) {
-	log.Debug("Beginning of AddInstance.")
-	tx, err := db.db.Begin()
+func (db *DB) listInstances(where string, args ...any) ([]Instance, error) {
+	instances := make([]Instance, 0)
+	stmt := "SELECT " + instanceColumns + " FROM AWSInstance " + where + " ORDER BY Account, Name, ID"
+	rows, err := db.db.Query(stmt, args...)
 	if err != nil {
-		LogAndQuit("Unable to add instance", err)
+		return instances, err
 	}
-	//defer tx.Commit()
+	defer rows.Close()
 
-	log.Debug("Preparing.")
-	stmt := `
-	INSERT INTO AWSInstance (
-		Account, AMI, ENV, ID, KeypairName, LaunchTime, Name, Notes, OS, PrivateIP, PublicIP,
-		Region, Size, SSHKey, SSHPort, State, Subnet, User, VPC, LastSeen
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-
-	log.Debug("Executing.")
-	_, err = tx.Exec(stmt,
-		i.Account, i.AMI, i.ENV, i.ID, i.KeypairName, i.LaunchTime, i.Name, i.Notes, i.OS, i.PrivateIP, i.PublicIP,
-		i.Region, i.Size, i.SSHKey, i.SSHPort, i.State, i.Subnet, i.User, i.VPC, time.Now(),
-	)
+	byID := make(map[string]int)
+	for rows.Next() {
+		i, err := scanInstance(rows)
+		if err != nil {
+			return instances, err
+		}
+		byID[i.ID] = len(instances)
+		instances = append(instances, i)
+	}
+	if err := rows.Err(); err != nil {
+		return instances, err
+	}
+
+	tags, err := db.db.Query("SELECT InstanceID, Key, Value FROM Tags")
 	if err != nil {
-		LogAndQuit("Unable to insert instance", err)
+		return instances, err
+	}
+	defer tags.Close()
+	for tags.Next() {
+		var id, k, v string
+		if err := tags.Scan(&id, &k, &v); err != nil {
+			return instances, err
+		}
+		if n, ok := byID[id]; ok {
+			instances[n].Tags[k] = v
+		}
 	}
+	return instances, tags.Err()
+}
 
-	log.Debug("Committing.")
-	err = tx.Commit()
+// FindInstances returns the instances, terminated or not, that pass the
+// filter, in the filter's order.
+func (db *DB) FindInstances(filter Filter) ([]Instance, error) {
+	instances, err := db.ListAllInstances()
 	if err != nil {
-		log.Debugf("Error committing: %v\n", err)
+		return nil, err
 	}
-	log.Debug("Committed.")
+	return filter.Apply(instances), nil
+}
+
+// StaleInstances lists instances that aren't terminated but haven't been
+// seen by a scan since the cutoff.
+func (db *DB) StaleInstances(cutoff time.Time) ([]Instance, error) {
+	return db.FindInstances(Filter{
+		Match:      []FieldMatch{{Field: "state", Patterns: []string{"terminated"}, Negate: true}},
+		SeenBefore: cutoff,
+	})
+}
+
+// SetNotes replaces the notes of an instance.
+func (db *DB) SetNotes(ID string, notes string) error {
+	_, err := db.db.Exec("UPDATE AWSInstance SET Notes = ? WHERE ID = ?", notes, ID)
+	return err
 }
 
-func (db *DB) DeleteTags(ID string) {
+// SetTags replaces the tags of an instance.
+func (db *DB) SetTags(ID string, tags map[string]string) error {
 	tx, err := db.db.Begin()
 	if err != nil {
-		LogAndQuit("Unable to begin transaction (DeleteTags)", err)
+		return err
 	}
-	defer tx.Commit()
 
-	stmt := "DELETE FROM Tags WHERE InstanceID = ?"
-	_, err = tx.Exec(stmt, ID)
+	_, err = tx.Exec("DELETE FROM Tags WHERE InstanceID = ?", ID)
 	if err != nil {
-		LogAndQuit("Unable to delete tag", err)
+		tx.Rollback()
+		return err
 	}
+	stmt := "INSERT OR REPLACE INTO Tags (InstanceID, Key, Value) VALUES (?, ?, ?)"
+	for k, v := range tags {
+		_, err = tx.Exec(stmt, ID, k, v)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (db *DB) AddTags(i Instance) {
-	// Init DB
-	tx, err := db.db.Begin()
+// SetFacts replaces the stored facts of an instance with a new collection.
+func (db *DB) SetFacts(ctx context.Context, ID string, facts map[string]string, collectedAt time.Time) error {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		LogAndQuit("Unable to begin transaction (AddTags)", err)
+		return err
 	}
-	defer tx.Commit()
 
-	// Delete old tags
-	db.DeleteTags(i.ID)
-	
-	// Add new tags
-	for k, v := range i.Tags {
-		stmt := "INSERT INTO Tags (InstanceID, Key, Value) VALUES (?, ?, ?)"
-		_, err := tx.Exec(stmt, i.ID, k, v)
+	_, err = tx.Exec("DELETE FROM Facts WHERE InstanceID = ?", ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt := "INSERT OR REPLACE INTO Facts (InstanceID, Key, Value, CollectedAt) VALUES (?, ?, ?, ?)"
+	for k, v := range facts {
+		_, err = tx.Exec(stmt, ID, k, v, collectedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetFacts returns the stored facts of an instance and when they were
+// collected.
+func (db *DB) GetFacts(ID string) (map[string]string, time.Time, error) {
+	facts := make(map[string]string)
+	var collectedAt time.Time
+
+	rows, err := db.db.Query("SELECT Key, Value, CollectedAt FROM Facts WHERE InstanceID = ?", ID)
+	if err != nil {
+		return facts, collectedAt, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k, v string
+		err := rows.Scan(&k, &v, &collectedAt)
 		if err != nil {
-			LogAndQuit("Unable to insert tag", err)
+			return facts, collectedAt, err
 		}
+		facts[k] = v
+	}
+	return facts, collectedAt, rows.Err()
+}
+
+// GetLogin returns the login found for an instance by an earlier run.
+func (db *DB) GetLogin(ID string) (string, string, string, error) {
+	var user, key, port sql.NullString
+	stmt := "SELECT User, SSHKey, SSHPort FROM AWSInstance WHERE ID = ?"
+	err := db.db.QueryRow(stmt, ID).Scan(&user, &key, &port)
+	if err != nil {
+		return "", "", "", err
 	}
+	return user.String, key.String, port.String, nil
 }
 
 func Pause() {
@@ -0,0 +1,62 @@
+package inventoryengine
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testDB(t *testing.T) *DB {
+	t.Helper()
+	db := OpenDB(filepath.Join(t.TempDir(), "inventory.db"))
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUpsertKeepsFactsOS(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	vm := Instance{ID: "vm-1", CloudProvider: "azure", OS: "Linux", State: "running"}
+	win := Instance{ID: "vm-2", CloudProvider: "azure", OS: "Linux", State: "running"}
+	if _, err := db.UpsertInstances(ctx, []Instance{vm, win}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFacts(ctx, vm.ID, map[string]string{"system.os.id": "ubuntu"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetOS(ctx, vm.ID, "Ubuntu 22.04.4 LTS"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next scan reports the cloud's OS type again.
+	win.OS = "Windows"
+	if _, err := db.UpsertInstances(ctx, []Instance{vm, win}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	stored, _, err := db.GetInstance(vm.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.OS != "Ubuntu 22.04.4 LTS" {
+		t.Errorf("OS = %q, want the one from facts", stored.OS)
+	}
+	history, err := db.InstanceHistory(vm.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range history {
+		if e.Event == "changed" {
+			t.Errorf("history has %+v", e)
+		}
+	}
+
+	// Without facts the scan still decides.
+	stored, _, err = db.GetInstance(win.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.OS != "Windows" {
+		t.Errorf("OS = %q, want Windows", stored.OS)
+	}
+}
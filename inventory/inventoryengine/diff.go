@@ -0,0 +1,392 @@
+package inventoryengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Backup is a copy of the database taken at the end of a run.
+type Backup struct {
+	File  string    `yaml:"file" json:"file"`
+	Time  time.Time `yaml:"time" json:"time"`
+	RunID int64     `yaml:"run_id" json:"run_id"`
+}
+
+var backupName = regexp.MustCompile(`^inventory-(\d{8}T\d{6}Z)-run(\d+)\.db$`)
+
+func (i *Inventory) backupDir() string {
+	return filepath.Join(i.Datadir(), "backups")
+}
+
+// BackupDB copies the database to <datadir>/backups after a run, keeping
+// max_backups copies.  With max_backups unset there are no backups.
+func (i *Inventory) BackupDB(runID int64, at time.Time) (string, error) {
+	keep := i.Config().Inventory.MaxBackups
+	if keep <= 0 {
+		return "", nil
+	}
+	dir := i.backupDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("inventory-%s-run%d.db", at.UTC().Format("20060102T150405Z"), runID)
+	file := filepath.Join(dir, name)
+	if err := i.db.Backup(file); err != nil {
+		return "", err
+	}
+	return file, pruneGenerations(dir, "inventory-", name, keep-1)
+}
+
+// Backups lists the database backups, oldest first.
+func (i *Inventory) Backups() ([]Backup, error) {
+	backups := make([]Backup, 0)
+	entries, err := os.ReadDir(i.backupDir())
+	if os.IsNotExist(err) {
+		return backups, nil
+	} else if err != nil {
+		return backups, err
+	}
+	for _, entry := range entries {
+		m := backupName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		at, _ := time.Parse("20060102T150405Z", m[1])
+		run, _ := strconv.ParseInt(m[2], 10, 64)
+		backups = append(backups, Backup{File: filepath.Join(i.backupDir(), entry.Name()), Time: at, RunID: run})
+	}
+	sort.Slice(backups, func(a, b int) bool { return backups[a].Time.Before(backups[b].Time) })
+	return backups, nil
+}
+
+// FieldChange is one field that differs between two snapshots.
+type FieldChange struct {
+	Field string `yaml:"field" json:"field"`
+	Old   string `yaml:"old" json:"old"`
+	New   string `yaml:"new" json:"new"`
+}
+
+// InstanceDiff is an instance that was "added", "removed" or "changed".
+type InstanceDiff struct {
+	Change   string        `yaml:"change" json:"change"`
+	ID       string        `yaml:"id" json:"id"`
+	Name     string        `yaml:"name" json:"name"`
+	Provider string        `yaml:"provider" json:"provider"`
+	Account  string        `yaml:"account" json:"account"`
+	Region   string        `yaml:"region" json:"region"`
+	Fields   []FieldChange `yaml:"fields,omitempty" json:"fields,omitempty"`
+}
+
+func newInstanceDiff(change string, instance Instance) InstanceDiff {
+	return InstanceDiff{
+		Change:   change,
+		ID:       instance.ID,
+		Name:     instance.Name,
+		Provider: instance.CloudProvider,
+		Account:  instance.Account,
+		Region:   instance.Region,
+	}
+}
+
+// compareInstances lists the tracked fields and tags that differ.
+func compareInstances(old Instance, new Instance) []FieldChange {
+	changes := make([]FieldChange, 0)
+	for _, field := range historyFields {
+		before, _ := FieldValue(old, field)
+		after, _ := FieldValue(new, field)
+		if before != after {
+			changes = append(changes, FieldChange{Field: field, Old: before, New: after})
+		}
+	}
+	keys := make(map[string]bool)
+	for k := range old.Tags {
+		keys[k] = true
+	}
+	for k := range new.Tags {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		if old.Tags[k] != new.Tags[k] {
+			changes = append(changes, FieldChange{Field: "tag:" + k, Old: old.Tags[k], New: new.Tags[k]})
+		}
+	}
+	return changes
+}
+
+func activeInstances(instances []Instance) map[string]Instance {
+	active := make(map[string]Instance)
+	for _, instance := range instances {
+		if instance.State != "terminated" {
+			active[instance.ID] = instance
+		}
+	}
+	return active
+}
+
+// DiffInstances compares two snapshots.  Terminated instances count as
+// gone.
+func DiffInstances(from []Instance, to []Instance) []InstanceDiff {
+	before, after := activeInstances(from), activeInstances(to)
+	ids := make(map[string]bool)
+	for id := range before {
+		ids[id] = true
+	}
+	for id := range after {
+		ids[id] = true
+	}
+
+	diffs := make([]InstanceDiff, 0)
+	for _, id := range sortedKeys(ids) {
+		a, inBefore := before[id]
+		b, inAfter := after[id]
+		switch {
+		case !inBefore:
+			diffs = append(diffs, newInstanceDiff("added", b))
+		case !inAfter:
+			diffs = append(diffs, newInstanceDiff("removed", a))
+		default:
+			if fields := compareInstances(a, b); len(fields) > 0 {
+				d := newInstanceDiff("changed", b)
+				d.Fields = fields
+				diffs = append(diffs, d)
+			}
+		}
+	}
+	return diffs
+}
+
+// DiffHistory folds history entries into per-instance changes.  Instances
+// that came and went in between don't show.
+func DiffHistory(entries []HistoryEntry, current map[string]Instance) []InstanceDiff {
+	type folded struct {
+		created, terminated bool
+		fields              map[string]*FieldChange
+		order               []string
+	}
+	byID := make(map[string]*folded)
+	for _, e := range entries {
+		f, ok := byID[e.InstanceID]
+		if !ok {
+			f = &folded{fields: make(map[string]*FieldChange)}
+			byID[e.InstanceID] = f
+		}
+		switch e.Event {
+		case "created":
+			f.created = true
+		case "terminated":
+			f.terminated = true
+		case "changed":
+			if c, ok := f.fields[e.Field]; ok {
+				c.New = e.New
+			} else {
+				f.fields[e.Field] = &FieldChange{Field: e.Field, Old: e.Old, New: e.New}
+				f.order = append(f.order, e.Field)
+			}
+		}
+	}
+
+	diffs := make([]InstanceDiff, 0)
+	for _, id := range sortedKeys(byID) {
+		f := byID[id]
+		instance, ok := current[id]
+		if !ok {
+			instance = Instance{ID: id}
+		}
+		switch {
+		case f.created && f.terminated:
+			continue
+		case f.created:
+			diffs = append(diffs, newInstanceDiff("added", instance))
+		case f.terminated:
+			diffs = append(diffs, newInstanceDiff("removed", instance))
+		default:
+			d := newInstanceDiff("changed", instance)
+			for _, field := range f.order {
+				if c := f.fields[field]; c.Old != c.New {
+					d.Fields = append(d.Fields, *c)
+				}
+			}
+			if len(d.Fields) > 0 {
+				diffs = append(diffs, d)
+			}
+		}
+	}
+	return diffs
+}
+
+// snapshot loads the instances a reference points to: "now", a backup
+// file, a run (the backup taken after it) or a time (the latest backup
+// taken by then).  It returns false for a run or time without a backup.
+func (i *Inventory) snapshot(ref string) ([]Instance, bool, error) {
+	if ref == "now" {
+		instances, err := i.db.ListAllInstances()
+		return instances, true, err
+	}
+	file := ""
+	if _, err := os.Stat(ref); err == nil {
+		file = ref
+	} else {
+		backups, err := i.Backups()
+		if err != nil {
+			return nil, false, err
+		}
+		if run, err := strconv.ParseInt(ref, 10, 64); err == nil {
+			for _, b := range backups {
+				if b.RunID == run {
+					file = b.File
+				}
+			}
+			if file == "" {
+				return nil, false, nil
+			}
+		} else {
+			at, err := ParseFilterTime(ref)
+			if err != nil {
+				return nil, false, fmt.Errorf("%q is not now, a run, a backup file or a time", ref)
+			}
+			for _, b := range backups {
+				if !b.Time.After(at) {
+					file = b.File
+				}
+			}
+			if file == "" {
+				return nil, false, nil
+			}
+		}
+	}
+	slog.Debug("Reading snapshot", "file", file)
+	db, err := OpenSnapshot(file)
+	if err != nil {
+		return nil, false, err
+	}
+	defer db.Close()
+	instances, err := db.ListAllInstances()
+	return instances, true, err
+}
+
+// historyRun is the run a reference stands for when comparing through the
+// history: the run itself, or for a time, the run in effect then.  It
+// returns 0 for a time before the first run.
+func (i *Inventory) historyRun(ref string) (int64, error) {
+	if run, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return run, nil
+	}
+	at, err := ParseFilterTime(ref)
+	if err != nil {
+		return 0, fmt.Errorf("%s has no backup and is not a run or a time", ref)
+	}
+	run, _, err := i.db.RunAt(at)
+	return run, err
+}
+
+// Diff compares two points in time; see snapshot for what from and to can
+// be.  Runs and times without backups are compared through the history
+// instead.
+func (i *Inventory) Diff(from string, to string) ([]InstanceDiff, error) {
+	before, fromOK, err := i.snapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	after, toOK, err := i.snapshot(to)
+	if err != nil {
+		return nil, err
+	}
+	if fromOK && toOK {
+		return DiffInstances(before, after), nil
+	}
+
+	if from == "now" {
+		return nil, fmt.Errorf("%s has no backup to compare now with", to)
+	}
+	fromRun, err := i.historyRun(from)
+	if err != nil {
+		return nil, err
+	}
+	var toRun int64
+	if to != "now" {
+		if toRun, err = i.historyRun(to); err != nil {
+			return nil, err
+		}
+		if toRun == 0 {
+			return nil, fmt.Errorf("no run by %s", to)
+		}
+	}
+	entries, err := i.db.HistoryBetween(fromRun, toRun)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := i.db.ListAllInstances()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]Instance)
+	for _, instance := range instances {
+		current[instance.ID] = instance
+	}
+	return DiffHistory(entries, current), nil
+}
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// WriteDiff renders differences as "table" or "json".  The table marks
+// added, removed and changed instances with +, - and ~, and colors the
+// changed fields if asked.
+func WriteDiff(w io.Writer, diffs []InstanceDiff, format string, color bool) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(diffs)
+	case "table", "":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	marks := map[string][2]string{
+		"added":   {"+", colorGreen},
+		"removed": {"-", colorRed},
+		"changed": {"~", colorYellow},
+	}
+	paint := func(text string, c string) string {
+		if !color {
+			return text
+		}
+		return c + text + colorReset
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, " \tPROVIDER\tACCOUNT\tREGION\tID\tNAME\tCHANGES")
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Change]++
+		mark := marks[d.Change]
+		changes := make([]string, 0, len(d.Fields))
+		for _, f := range d.Fields {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", f.Field, f.Old, f.New))
+		}
+		// tabwriter counts escape codes as width, so only the trailing
+		// column, which isn't padded, is colored.
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", mark[0], d.Provider, d.Account, d.Region, d.ID, d.Name,
+			paint(strings.Join(changes, ", "), mark[1]))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", counts["added"], counts["removed"], counts["changed"])
+	return nil
+}
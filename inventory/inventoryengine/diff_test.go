@@ -0,0 +1,132 @@
+package inventoryengine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Without max_backups, times are compared through the history of the runs
+// in effect then.
+func TestDiffTimeWithoutBackups(t *testing.T) {
+	ctx := context.Background()
+	i := testInventory(t, testSettings(t, fmt.Sprintf("inventory:\n  datadir: %s\n", t.TempDir())))
+	start := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+
+	roll := func(at time.Time, instances ...Instance) {
+		t.Helper()
+		run, err := i.db.StartRun(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := i.db.UpsertInstances(ctx, instances, at); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.db.FinishRun(Run{ID: run, FinishedAt: at.Add(time.Minute), Status: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roll(start, Instance{ID: "i-1", Name: "web", State: "running"})
+	roll(start.Add(time.Hour), Instance{ID: "i-1", Name: "web1", State: "running"}, Instance{ID: "i-2", State: "running"})
+
+	changes := func(diffs []InstanceDiff) string {
+		parts := make([]string, 0, len(diffs))
+		for _, d := range diffs {
+			parts = append(parts, d.Change+" "+d.ID)
+		}
+		return strings.Join(parts, ", ")
+	}
+	at := func(d time.Duration) string { return start.Add(d).Format(time.RFC3339) }
+
+	tests := []struct {
+		from, to string
+		want     string
+	}{
+		{at(30 * time.Minute), "now", "changed i-1, added i-2"},
+		{at(-time.Hour), at(30 * time.Minute), "added i-1"},
+		{"1", at(2 * time.Hour), "changed i-1, added i-2"},
+		{at(2 * time.Hour), "now", ""},
+	}
+	for _, tt := range tests {
+		diffs, err := i.Diff(tt.from, tt.to)
+		if err != nil {
+			t.Errorf("Diff(%s, %s): %v", tt.from, tt.to, err)
+			continue
+		}
+		if got := changes(diffs); got != tt.want {
+			t.Errorf("Diff(%s, %s) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	if _, err := i.Diff(at(-2*time.Hour), at(-time.Hour)); err == nil || !strings.Contains(err.Error(), "no run by") {
+		t.Errorf("Diff before the first run: %v", err)
+	}
+}
+
+func TestWriteDiffColorAligned(t *testing.T) {
+	diffs := []InstanceDiff{
+		{Change: "added", ID: "i-1", Provider: "aws", Account: "prod", Region: "us-east-1"},
+		{Change: "changed", ID: "i-2", Provider: "aws", Account: "prod", Region: "us-east-1",
+			Fields: []FieldChange{{Field: "state", Old: "running", New: "stopped"}}},
+	}
+	var b strings.Builder
+	if err := WriteDiff(&b, diffs, "table", true); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	column := strings.Index(lines[0], "PROVIDER")
+	for _, line := range lines[1:3] {
+		if strings.Index(line, "aws") != column {
+			t.Errorf("row %q is not aligned with header %q", line, lines[0])
+		}
+	}
+	if !strings.Contains(lines[2], colorYellow+`state: "running" -> "stopped"`+colorReset) {
+		t.Errorf("changes not colored: %q", lines[2])
+	}
+}
+
+// Snapshots are read as they are: backups aren't migrated, and a file that
+// isn't a database is an error rather than the end of the process.
+func TestDiffSnapshotReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	i := testInventory(t, testSettings(t, fmt.Sprintf("inventory:\n  datadir: %s\n  max_backups: 2\n", dir)))
+	if _, err := i.db.UpsertInstances(ctx, []Instance{{ID: "i-1", State: "running"}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := i.BackupDB(1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.db.UpsertInstances(ctx, []Instance{{ID: "i-2", State: "running"}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := i.Diff(backup, "now")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Change != "added" || diffs[0].ID != "i-2" {
+		t.Errorf("diffs = %+v, want i-2 added", diffs)
+	}
+	if after, _ := os.ReadFile(backup); !bytes.Equal(before, after) {
+		t.Error("reading the backup changed it")
+	}
+
+	junk := filepath.Join(dir, "typo.txt")
+	if err := os.WriteFile(junk, []byte("not a database\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Diff(junk, "now"); err == nil || !strings.Contains(err.Error(), "not an inventory database") {
+		t.Errorf("Diff from a text file: %v", err)
+	}
+}
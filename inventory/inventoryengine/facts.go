@@ -0,0 +1,268 @@
+package inventoryengine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+	"github.com/ascheel/goinventory/inventory/sshtest"
+)
+
+// Runner executes a shell command on a remote host.  sshtest.Client is the
+// real implementation; anything else can stand in for it.
+type Runner interface {
+	Run(command string) (string, error)
+}
+
+// FactGatherer collects a named set of facts from a host that we can log in
+// to.  Keys returned are stored prefixed with the gatherer's name; ctx
+// carries the log attributes of the run and instance.
+type FactGatherer interface {
+	Name() string
+	Gather(ctx context.Context, r Runner, instance Instance, c *config.Settings) (map[string]string, error)
+}
+
+var factGatherers = []FactGatherer{
+	SystemFacts{},
+	UserFacts{},
+	AgentFacts{},
+	LdapFacts{},
+}
+
+// RegisterFactGatherer adds a gatherer to the set run after each login.
+func RegisterFactGatherer(g FactGatherer) {
+	factGatherers = append(factGatherers, g)
+}
+
+// GatherFacts runs every registered gatherer against one host.  A failing
+// gatherer is logged and skipped so that the others still report.
+func GatherFacts(ctx context.Context, r Runner, instance Instance, c *config.Settings) map[string]string {
+	facts := make(map[string]string)
+	for _, g := range factGatherers {
+		result, err := g.Gather(ctx, r, instance, c)
+		if err != nil {
+			slog.WarnContext(ctx, "Fact gatherer failed", "gatherer", g.Name(), "err", err)
+			continue
+		}
+		for k, v := range result {
+			facts[g.Name()+"."+k] = v
+		}
+	}
+	return facts
+}
+
+func runTrimmed(r Runner, command string) (string, error) {
+	output, err := r.Run(command)
+	return strings.TrimSpace(output), err
+}
+
+// SystemFacts covers the basics: identity, OS, hardware and package count.
+type SystemFacts struct{}
+
+func (SystemFacts) Name() string { return "system" }
+
+func (SystemFacts) Gather(ctx context.Context, r Runner, instance Instance, c *config.Settings) (map[string]string, error) {
+	facts := make(map[string]string)
+	commands := map[string]string{
+		"hostname":    "hostname",
+		"kernel":      "uname -r",
+		"kernel_name": "uname -s",
+		"arch":        "uname -m",
+		"cpus":        "nproc",
+		"memory_kb":   "awk '/^MemTotal:/ {print $2}' /proc/meminfo",
+		"uptime":      "cut -d' ' -f1 /proc/uptime",
+		"packages":    "(rpm -qa 2>/dev/null || dpkg-query -W -f '.\\n' 2>/dev/null) | wc -l",
+	}
+	for key, command := range commands {
+		value, err := runTrimmed(r, command)
+		if err != nil {
+			slog.DebugContext(ctx, "Fact command failed", "command", command, "err", err)
+			continue
+		}
+		facts[key] = value
+	}
+
+	osRelease, err := r.Run("cat /etc/os-release")
+	if err != nil {
+		return facts, nil
+	}
+	for k, v := range ParseOSRelease(osRelease) {
+		facts["os."+strings.ToLower(k)] = v
+	}
+	return facts, nil
+}
+
+// ParseOSRelease reads the KEY=value lines of /etc/os-release.
+func ParseOSRelease(contents string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[k] = strings.Trim(v, `"'`)
+	}
+	return values
+}
+
+// UserFacts lists the members of each group in ssh.ldap_groups as the host
+// resolves them.
+type UserFacts struct{}
+
+func (UserFacts) Name() string { return "users" }
+
+func (UserFacts) Gather(ctx context.Context, r Runner, instance Instance, c *config.Settings) (map[string]string, error) {
+	facts := make(map[string]string)
+	for _, group := range c.SSH.LdapGroups {
+		output, err := runTrimmed(r, fmt.Sprintf("getent group %s", shellQuote(group)))
+		if err != nil {
+			facts[group] = ""
+			continue
+		}
+		// name:x:gid:member,member
+		fields := strings.Split(output, ":")
+		facts[group] = fields[len(fields)-1]
+	}
+	return facts, nil
+}
+
+// AgentFacts reports on the security agents configured for the account: the
+// CrowdStrike Falcon sensor and the Splunk universal forwarder.
+type AgentFacts struct{}
+
+func (AgentFacts) Name() string { return "agents" }
+
+const falconctl = "/opt/CrowdStrike/falconctl"
+
+func (AgentFacts) Gather(ctx context.Context, r Runner, instance Instance, c *config.Settings) (map[string]string, error) {
+	facts := make(map[string]string)
+	account := c.AWS.Accounts[instance.Account]
+
+	_, err := r.Run("test -x " + falconctl)
+	facts["falcon.installed"] = fmt.Sprint(err == nil)
+	_, err = r.Run("pgrep -x falcon-sensor")
+	facts["falcon.running"] = fmt.Sprint(err == nil)
+	// falconctl needs root; without passwordless sudo the tags stay unknown.
+	tags, err := runTrimmed(r, "sudo -n "+falconctl+" -g --tags")
+	if err == nil {
+		facts["falcon.tags"] = strings.Join(ParseFalconTags(tags), ",")
+	}
+
+	splunkDir := account.SplunkDir
+	if splunkDir == "" {
+		splunkDir = "/opt/splunkforwarder"
+	}
+	facts["splunk.dir"] = splunkDir
+	_, err = r.Run(fmt.Sprintf("test -x %s", shellQuote(splunkDir+"/bin/splunk")))
+	facts["splunk.installed"] = fmt.Sprint(err == nil)
+	_, err = r.Run(fmt.Sprintf("pgrep -f %s", shellQuote(splunkDir+"/bin/splunkd")))
+	facts["splunk.running"] = fmt.Sprint(err == nil)
+	return facts, nil
+}
+
+// ParseFalconTags reads the output of `falconctl -g --tags`, which looks like
+// "Sensor grouping tags are not set." or "tags=env-prod,team-x."
+func ParseFalconTags(output string) []string {
+	tags := make([]string, 0)
+	_, value, ok := strings.Cut(output, "tags=")
+	if !ok {
+		return tags
+	}
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "."))
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// GatherAllFacts logs in to every running instance with a known login and
+// stores what the gatherers find.  Stopped ones would only time out.
+func (i *Inventory) GatherAllFacts(ctx context.Context) {
+	slog.DebugContext(ctx, "Gathering facts.")
+	c := i.Config()
+	for id, instance := range i.Instances {
+		if ctx.Err() != nil {
+			return
+		}
+		if instance.State != "running" {
+			continue
+		}
+		ctx := WithLogAttrs(ctx, "instance", id)
+		if instance.User == "" || instance.SSHKey == "" {
+			user, key, port, err := i.db.GetLogin(id)
+			if err != nil || user == "" || key == "" {
+				continue
+			}
+			instance.User, instance.SSHKey, instance.SSHPort = user, key, port
+		}
+		address, err := instance.GetConnectionAddress()
+		if err != nil {
+			continue
+		}
+		conn := sshtest.ConnectionInfo{
+			Host:    address,
+			User:    instance.User,
+			Port:    instance.GetPort(),
+			Key:     instance.SSHKey,
+			Timeout: i.timeouts.SSH,
+		}
+		client, err := conn.ConnectContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		i.recordProbe(err)
+		i.setReachable(id, err == nil)
+		if err != nil {
+			slog.WarnContext(ctx, "Unable to connect for facts", "err", err)
+			continue
+		}
+		// Commands don't know about ctx either; closing the client ends them.
+		stop := context.AfterFunc(ctx, func() { client.Close() })
+		facts := GatherFacts(ctx, client, instance, c)
+		stop()
+		client.Close()
+		if ctx.Err() != nil {
+			// Facts from a half finished gather would wipe good ones.
+			return
+		}
+
+		if err := i.db.SetFacts(ctx, id, facts, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "Unable to store facts", "err", err)
+		}
+		if os := OSFromFacts(c, facts); os != "" && os != instance.OS {
+			instance.OS = os
+			if err := i.db.SetOS(ctx, id, os); err != nil {
+				slog.ErrorContext(ctx, "Unable to store OS", "err", err)
+			}
+		}
+		i.Instances[id] = instance
+	}
+}
+
+// OSFromFacts names the OS from os-release, translated through os_map when
+// the ID is listed there.
+func OSFromFacts(c *config.Settings, facts map[string]string) string {
+	id := facts["system.os.id"]
+	if name, ok := c.Inventory.OsMap[id]; ok {
+		return name
+	}
+	if pretty := facts["system.os.pretty_name"]; pretty != "" {
+		return pretty
+	}
+	return id
+}
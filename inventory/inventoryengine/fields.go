@@ -0,0 +1,84 @@
+package inventoryengine
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// FieldValue returns an Instance field as a string.  Fields can be named by
+// their Go name or yaml key, case-insensitively; "tag:Key" reads a tag.
+func FieldValue(instance Instance, name string) (string, bool) {
+	if tag, ok := strings.CutPrefix(name, "tag:"); ok {
+		value, found := instance.Tags[tag]
+		return value, found
+	}
+	field, ok := instanceField(name)
+	if !ok {
+		return "", false
+	}
+	v := reflect.ValueOf(instance).FieldByIndex(field.Index)
+	switch value := v.Interface().(type) {
+	case string:
+		return value, true
+	case bool:
+		if value {
+			return "true", true
+		}
+		return "false", true
+	case time.Time:
+		if value.IsZero() {
+			return "", true
+		}
+		return value.UTC().Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// FieldName returns the canonical (yaml) name of a field, or "" if the
+// Instance has no such field.  Tag references are returned unchanged.
+func FieldName(name string) string {
+	if strings.HasPrefix(name, "tag:") {
+		return name
+	}
+	field, ok := instanceField(name)
+	if !ok {
+		return ""
+	}
+	return yamlName(field)
+}
+
+// FieldNames lists the yaml names of every scalar Instance field.
+func FieldNames() []string {
+	names := make([]string, 0)
+	t := reflect.TypeOf(Instance{})
+	for n := 0; n < t.NumField(); n++ {
+		if t.Field(n).Type.Kind() == reflect.Map {
+			continue
+		}
+		names = append(names, yamlName(t.Field(n)))
+	}
+	return names
+}
+
+func instanceField(name string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(Instance{})
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		if f.Type.Kind() == reflect.Map {
+			continue
+		}
+		if strings.EqualFold(f.Name, name) || strings.EqualFold(yamlName(f), name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
@@ -0,0 +1,310 @@
+package inventoryengine
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FieldMatch compares one field, or "tag:Key", against glob patterns.  Any
+// pattern matching is enough; Negate inverts the result.  With no patterns
+// it only checks that the field (in practice, the tag) exists.
+type FieldMatch struct {
+	Field    string
+	Patterns []string
+	Negate   bool
+}
+
+// Filter selects instances from the database.  Every set condition has to
+// hold.  Sort names fields to order by, "-field" for descending.
+type Filter struct {
+	Match          []FieldMatch
+	LaunchedBefore time.Time
+	LaunchedAfter  time.Time
+	SeenBefore     time.Time
+	SeenAfter      time.Time
+	Sort           []string
+	Limit          int
+}
+
+// ParseFilter reads the filter expression used on the command line.  Terms
+// are separated by spaces and all have to hold.  Double or single quotes, or
+// a backslash, keep spaces in a value: name="web server*".
+//
+//	field=pattern[,pattern]    equality or glob (*, ?, [...]) on any field
+//	field!=pattern[,pattern]   negated
+//	tag:Key / !tag:Key         tag present / absent
+//	tag:Key=pattern            tag value
+//	launched-before=T          also launched-after, last-seen-before and
+//	                           last-seen-after; last-seen=T is last-seen-after
+//	sort=field[,-field]
+//	limit=N
+//
+// T is a date (2006-01-02), a timestamp (RFC 3339) or an age such as 36h,
+// 7d or 2w.  Matching is case-insensitive, and * and ? match '/' too.
+func ParseFilter(args ...string) (Filter, error) {
+	var f Filter
+	for _, arg := range args {
+		terms, err := splitFilterTerms(arg)
+		if err != nil {
+			return f, err
+		}
+		for _, term := range terms {
+			if err := f.parseTerm(term); err != nil {
+				return f, err
+			}
+		}
+	}
+	return f, nil
+}
+
+// splitFilterTerms splits one argument on spaces outside quotes, dropping
+// the quotes and backslashes.
+func splitFilterTerms(arg string) ([]string, error) {
+	terms := make([]string, 0)
+	var term strings.Builder
+	inTerm := false
+	var quote rune
+	escaped := false
+	for _, r := range arg {
+		switch {
+		case escaped:
+			term.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inTerm = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			term.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inTerm = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inTerm {
+				terms = append(terms, term.String())
+				term.Reset()
+				inTerm = false
+			}
+		default:
+			term.WriteRune(r)
+			inTerm = true
+		}
+	}
+	if quote != 0 || escaped {
+		return terms, fmt.Errorf("filter %q: unterminated quote or escape", arg)
+	}
+	if inTerm {
+		terms = append(terms, term.String())
+	}
+	return terms, nil
+}
+
+func (f *Filter) parseTerm(term string) error {
+	key, value, hasValue := strings.Cut(term, "=")
+	negate := false
+	if strings.HasSuffix(key, "!") {
+		key, negate = strings.TrimSuffix(key, "!"), true
+	}
+
+	if !hasValue {
+		name, absent := strings.CutPrefix(key, "!")
+		if !strings.HasPrefix(name, "tag:") {
+			return fmt.Errorf("filter %q: expected field=value", term)
+		}
+		f.Match = append(f.Match, FieldMatch{Field: name, Negate: absent})
+		return nil
+	}
+
+	var err error
+	switch strings.ToLower(key) {
+	case "launched-before":
+		f.LaunchedBefore, err = ParseFilterTime(value)
+	case "launched-after":
+		f.LaunchedAfter, err = ParseFilterTime(value)
+	case "last-seen-before":
+		f.SeenBefore, err = ParseFilterTime(value)
+	case "last-seen-after", "last-seen":
+		f.SeenAfter, err = ParseFilterTime(value)
+	case "sort":
+		for _, field := range strings.Split(value, ",") {
+			if FieldName(strings.TrimPrefix(field, "-")) == "" {
+				return fmt.Errorf("filter %q: unknown field %q", term, field)
+			}
+			f.Sort = append(f.Sort, field)
+		}
+	case "limit":
+		f.Limit, err = strconv.Atoi(value)
+		if err == nil && f.Limit < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	default:
+		if FieldName(key) == "" {
+			return fmt.Errorf("filter %q: unknown field %q", term, key)
+		}
+		patterns := strings.Split(value, ",")
+		for _, pattern := range patterns {
+			if _, err := globRegexp(pattern); err != nil {
+				return fmt.Errorf("filter %q: bad pattern %q", term, pattern)
+			}
+		}
+		f.Match = append(f.Match, FieldMatch{Field: key, Patterns: patterns, Negate: negate})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("filter %q: %v", term, err)
+	}
+	if negate {
+		return fmt.Errorf("filter %q: %s can't be negated", term, key)
+	}
+	return nil
+}
+
+// ParseFilterTime reads a date, a timestamp or an age ("7d") counted back
+// from now.
+func ParseFilterTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	age, err := parseAge(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q", value)
+	}
+	return time.Now().Add(-age), nil
+}
+
+// parseAge extends time.ParseDuration with days and weeks.
+func parseAge(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+// Matches reports whether one field matches.
+func (m FieldMatch) Matches(instance Instance) bool {
+	value, found := FieldValue(instance, m.Field)
+	if len(m.Patterns) == 0 {
+		return found != m.Negate
+	}
+	matched := false
+	if found {
+		for _, pattern := range m.Patterns {
+			if re, err := globRegexp(pattern); err == nil && re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != m.Negate
+}
+
+var globs sync.Map
+
+// globRegexp turns a glob into an anchored, case-insensitive regexp.  Unlike
+// path.Match, * and ? match '/' too, as IDs, keys and notes are full of
+// them.  [...] is a character class, [!...] or [^...] a negated one, and a
+// backslash escapes the next character.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := globs.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for n := 0; n < len(pattern); n++ {
+		switch c := pattern[n]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if n+1 == len(pattern) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			n++
+			b.WriteString(regexp.QuoteMeta(pattern[n : n+1]))
+		case '[':
+			end := strings.IndexByte(pattern[n+1:], ']')
+			if end <= 0 {
+				return nil, fmt.Errorf("unterminated or empty [")
+			}
+			class := pattern[n+1 : n+1+end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, "[", `\[`) + "]")
+			n += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	globs.Store(pattern, re)
+	return re, nil
+}
+
+// Matches reports whether an instance passes every condition of the filter.
+// Sort and Limit don't apply to single instances.
+func (f Filter) Matches(instance Instance) bool {
+	for _, m := range f.Match {
+		if !m.Matches(instance) {
+			return false
+		}
+	}
+	if !f.LaunchedBefore.IsZero() && !instance.LaunchTime.Before(f.LaunchedBefore) {
+		return false
+	}
+	if !f.LaunchedAfter.IsZero() && !instance.LaunchTime.After(f.LaunchedAfter) {
+		return false
+	}
+	if !f.SeenBefore.IsZero() && !instance.LastSeen.Before(f.SeenBefore) {
+		return false
+	}
+	if !f.SeenAfter.IsZero() && !instance.LastSeen.After(f.SeenAfter) {
+		return false
+	}
+	return true
+}
+
+// Apply filters, sorts and limits a list of instances.
+func (f Filter) Apply(instances []Instance) []Instance {
+	matched := make([]Instance, 0)
+	for _, instance := range instances {
+		if f.Matches(instance) {
+			matched = append(matched, instance)
+		}
+	}
+	if len(f.Sort) > 0 {
+		sort.SliceStable(matched, func(a, b int) bool {
+			for _, field := range f.Sort {
+				name, desc := strings.CutPrefix(field, "-")
+				x, _ := FieldValue(matched[a], name)
+				y, _ := FieldValue(matched[b], name)
+				if x == y {
+					continue
+				}
+				return (x < y) != desc
+			}
+			return false
+		})
+	}
+	if f.Limit > 0 && len(matched) > f.Limit {
+		matched = matched[:f.Limit]
+	}
+	return matched
+}
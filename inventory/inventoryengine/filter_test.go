@@ -0,0 +1,104 @@
+package inventoryengine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilterQuoting(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []FieldMatch
+	}{
+		{
+			args: []string{"state!=terminated", "name=web*"},
+			want: []FieldMatch{
+				{Field: "state", Patterns: []string{"terminated"}, Negate: true},
+				{Field: "name", Patterns: []string{"web*"}},
+			},
+		},
+		{
+			args: []string{"name=web* state=running"},
+			want: []FieldMatch{
+				{Field: "name", Patterns: []string{"web*"}},
+				{Field: "state", Patterns: []string{"running"}},
+			},
+		},
+		{
+			args: []string{`name="web server*" state=running`},
+			want: []FieldMatch{
+				{Field: "name", Patterns: []string{"web server*"}},
+				{Field: "state", Patterns: []string{"running"}},
+			},
+		},
+		{
+			args: []string{`name='web server*'`},
+			want: []FieldMatch{{Field: "name", Patterns: []string{"web server*"}}},
+		},
+		{
+			args: []string{`name=web\ server*`},
+			want: []FieldMatch{{Field: "name", Patterns: []string{"web server*"}}},
+		},
+		{
+			args: []string{`tag:Team="data eng",ops`},
+			want: []FieldMatch{{Field: "tag:Team", Patterns: []string{"data eng", "ops"}}},
+		},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.args...)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(f.Match, tt.want) {
+			t.Errorf("ParseFilter(%q) = %+v, want %+v", tt.args, f.Match, tt.want)
+		}
+	}
+}
+
+func TestParseFilterUnterminated(t *testing.T) {
+	for _, arg := range []string{`name="web server*`, `name=web\`} {
+		if _, err := ParseFilter(arg); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded", arg)
+		}
+	}
+}
+
+func TestFieldMatchGlob(t *testing.T) {
+	instance := Instance{
+		ID:     "/subscriptions/0000/resourceGroups/RG-Web/providers/Microsoft.Compute/virtualMachines/web01",
+		SSHKey: "/home/u/.ssh/id_rsa",
+		Notes:  "moved from dc1/rack4",
+		Tags:   map[string]string{"Path": "team/web"},
+	}
+	tests := []struct {
+		term string
+		want bool
+	}{
+		{"ssh_key=*id_rsa", true},
+		{"ssh_key=*/.ssh/id_???", true},
+		{"ssh_key=id_rsa", false},
+		{"id=*/resourcegroups/rg-web/*", true},
+		{"id=*/virtualMachines/web0[1-3]", true},
+		{"id=*/virtualMachines/web0[!1]", false},
+		{"notes=*dc1/*", true},
+		{"tag:Path=team/*", true},
+		{"tag:Path!=team/*", false},
+		{"name=?*", false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.term)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.term, err)
+			continue
+		}
+		if got := f.Matches(instance); got != tt.want {
+			t.Errorf("%s matches = %v, want %v", tt.term, got, tt.want)
+		}
+	}
+	for _, term := range []string{"name=web[", "name=[]"} {
+		if _, err := ParseFilter(term); err == nil {
+			t.Errorf("ParseFilter(%q) succeeded", term)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package inventoryengine
+
+import (
+	"testing"
+
+	"github.com/ascheel/goinventory/inventory/config"
+	"gopkg.in/yaml.v3"
+)
+
+// testSettings reads settings from YAML the way the settings file is read.
+func testSettings(t *testing.T, text string) *config.Settings {
+	t.Helper()
+	c := &config.Settings{}
+	if err := yaml.Unmarshal([]byte(text), c); err != nil {
+		t.Fatalf("bad test settings: %v", err)
+	}
+	return c
+}
+
+// testInventory is an inventory over the given settings and a fresh
+// database.
+func testInventory(t *testing.T, c *config.Settings) *Inventory {
+	t.Helper()
+	return &Inventory{config: c, db: testDB(t)}
+}
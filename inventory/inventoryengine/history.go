@@ -0,0 +1,345 @@
+package inventoryengine
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Run is one refresh of the inventory.
+type Run struct {
+	ID         int64     `yaml:"id" json:"id"`
+	StartedAt  time.Time `yaml:"started_at" json:"started_at"`
+	FinishedAt time.Time `yaml:"finished_at" json:"finished_at"`
+	Status     string    `yaml:"status" json:"status"`
+	Found      int       `yaml:"found" json:"found"`
+	New        int       `yaml:"new" json:"new"`
+	Terminated int       `yaml:"terminated" json:"terminated"`
+	Failed     int       `yaml:"failed_scopes" json:"failed_scopes"`
+	Error      string    `yaml:"error" json:"error"`
+}
+
+// HistoryEntry records something that happened to an instance: it was
+// "created", a field "changed", or it was "terminated".
+type HistoryEntry struct {
+	InstanceID string    `yaml:"instance_id" json:"instance_id"`
+	RunID      int64     `yaml:"run_id" json:"run_id"`
+	Time       time.Time `yaml:"time" json:"time"`
+	Event      string    `yaml:"event" json:"event"`
+	Field      string    `yaml:"field,omitempty" json:"field,omitempty"`
+	Old        string    `yaml:"old" json:"old"`
+	New        string    `yaml:"new" json:"new"`
+}
+
+// historyFields are compared on every upsert.  Logins, notes and the seen
+// timestamps change too often, or too quietly, to be worth recording.
+var historyFields = []string{
+	"name", "state", "account", "region", "env", "ami", "size", "os",
+	"private_ip", "public_ip", "subnet", "vpc", "keypair_name",
+}
+
+func createHistoryTables(tx *sql.Tx) error {
+	stmts := []string{`
+	CREATE TABLE IF NOT EXISTS
+		Runs (
+			ID INTEGER PRIMARY KEY AUTOINCREMENT,
+			StartedAt DATETIME,
+			FinishedAt DATETIME,
+			Status TEXT,
+			Found INTEGER,
+			New INTEGER,
+			Terminated INTEGER,
+			Failed INTEGER,
+			Error TEXT
+		)`, `
+	CREATE TABLE IF NOT EXISTS
+		History (
+			InstanceID TEXT,
+			RunID INTEGER,
+			Time DATETIME,
+			Event TEXT,
+			Field TEXT,
+			Old TEXT,
+			New TEXT
+		)`,
+		"CREATE INDEX IF NOT EXISTS History_InstanceID ON History (InstanceID)", `
+	CREATE TABLE IF NOT EXISTS
+		Scans (
+			Provider TEXT,
+			Account TEXT,
+			Region TEXT,
+			LastScan DATETIME,
+			LastSuccess DATETIME,
+			Duration REAL,
+			Count INTEGER,
+			Error TEXT,
+			PRIMARY KEY (Provider, Account, Region)
+		)`, `
+	CREATE TABLE IF NOT EXISTS
+		Notified (
+			InstanceID TEXT,
+			Event TEXT,
+			Time DATETIME,
+			PRIMARY KEY (InstanceID, Event)
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instanceChanges lists the history entries between two versions of an
+// instance.  Empty values in the scan don't count for fields the upsert
+// keeps.
+func instanceChanges(old Instance, new Instance) []HistoryEntry {
+	changes := make([]HistoryEntry, 0)
+	for _, field := range historyFields {
+		before, _ := FieldValue(old, field)
+		after, _ := FieldValue(new, field)
+		if before == after || field == "os" && after == "" {
+			continue
+		}
+		changes = append(changes, HistoryEntry{InstanceID: new.ID, Event: "changed", Field: field, Old: before, New: after})
+	}
+	return changes
+}
+
+func (db *DB) addHistory(tx *sql.Tx, entries []HistoryEntry, at time.Time) error {
+	var run any
+	if db.run != 0 {
+		run = db.run
+	}
+	for _, e := range entries {
+		_, err := tx.Exec("INSERT INTO History (InstanceID, RunID, Time, Event, Field, Old, New) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			e.InstanceID, run, at, e.Event, e.Field, e.Old, e.New)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartRun records the start of a refresh.  History written until FinishRun
+// belongs to it.
+func (db *DB) StartRun(startedAt time.Time) (int64, error) {
+	result, err := db.db.Exec("INSERT INTO Runs (StartedAt, Status) VALUES (?, 'running')", startedAt)
+	if err != nil {
+		return 0, err
+	}
+	db.run, err = result.LastInsertId()
+	return db.run, err
+}
+
+func (db *DB) FinishRun(run Run) error {
+	db.run = 0
+	_, err := db.db.Exec(
+		"UPDATE Runs SET FinishedAt = ?, Status = ?, Found = ?, New = ?, Terminated = ?, Failed = ?, Error = ? WHERE ID = ?",
+		run.FinishedAt, run.Status, run.Found, run.New, run.Terminated, run.Failed, run.Error, run.ID,
+	)
+	return err
+}
+
+// ScanStatus is the latest outcome of scanning a scope.
+type ScanStatus struct {
+	Scope       Scope     `yaml:"scope" json:"scope"`
+	LastScan    time.Time `yaml:"last_scan" json:"last_scan"`
+	LastSuccess time.Time `yaml:"last_success" json:"last_success"`
+	Duration    float64   `yaml:"duration_seconds" json:"duration_seconds"`
+	Count       int       `yaml:"count" json:"count"`
+	Error       string    `yaml:"error" json:"error"`
+}
+
+// RecordScans keeps the outcome of every scope scanned, and when it last
+// succeeded.  Scopes narrowed to an environment only saw part of theirs and
+// are left out.
+func (db *DB) RecordScans(results []ScopeResult, at time.Time) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+	INSERT INTO Scans (Provider, Account, Region, LastScan, LastSuccess, Duration, Count, Error)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(Provider, Account, Region) DO UPDATE SET
+		LastScan = excluded.LastScan,
+		LastSuccess = COALESCE(excluded.LastSuccess, LastSuccess),
+		Duration = excluded.Duration,
+		Count = excluded.Count,
+		Error = excluded.Error`
+	for _, r := range results {
+		if r.Scope.Env != "" {
+			continue
+		}
+		var success any
+		errText := ""
+		if r.Err == nil {
+			success = at
+		} else {
+			errText = r.Err.Error()
+		}
+		_, err := tx.Exec(stmt, r.Scope.Provider, r.Scope.Account, r.Scope.Region, at, success, r.Duration.Seconds(), r.Count, errText)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) ListScans() ([]ScanStatus, error) {
+	scans := make([]ScanStatus, 0)
+	rows, err := db.db.Query(`
+	SELECT Provider, Account, Region, LastScan, LastSuccess, Duration, Count, Error
+	FROM Scans ORDER BY Provider, Account, Region`)
+	if err != nil {
+		return scans, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s ScanStatus
+		var lastSuccess sql.NullTime
+		var scanErr sql.NullString
+		err := rows.Scan(&s.Scope.Provider, &s.Scope.Account, &s.Scope.Region, &s.LastScan, &lastSuccess, &s.Duration, &s.Count, &scanErr)
+		if err != nil {
+			return scans, err
+		}
+		s.LastSuccess, s.Error = lastSuccess.Time, scanErr.String
+		scans = append(scans, s)
+	}
+	return scans, rows.Err()
+}
+
+// Notified returns the instances already notified of for an event that
+// lasts, such as "unreachable".
+func (db *DB) Notified(event string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	rows, err := db.db.Query("SELECT InstanceID FROM Notified WHERE Event = ?", event)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// SetNotified records that instances were notified of for an event, and
+// forgets the ones it has cleared for, so they are notified of again if it
+// comes back.
+func (db *DB) SetNotified(event string, added []string, cleared []string, at time.Time) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range added {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO Notified (InstanceID, Event, Time) VALUES (?, ?, ?)", id, event, at); err != nil {
+			return err
+		}
+	}
+	for _, id := range cleared {
+		if _, err := tx.Exec("DELETE FROM Notified WHERE InstanceID = ? AND Event = ?", id, event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListRuns returns the latest runs, newest first.
+func (db *DB) ListRuns(limit int) ([]Run, error) {
+	runs := make([]Run, 0)
+	rows, err := db.db.Query(`
+	SELECT ID, StartedAt, FinishedAt, Status, Found, New, Terminated, Failed, Error
+	FROM Runs ORDER BY ID DESC LIMIT ?`, limit)
+	if err != nil {
+		return runs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Run
+		var finishedAt sql.NullTime
+		var status, runErr sql.NullString
+		var found, added, terminated, failed sql.NullInt64
+		err := rows.Scan(&r.ID, &r.StartedAt, &finishedAt, &status, &found, &added, &terminated, &failed, &runErr)
+		if err != nil {
+			return runs, err
+		}
+		r.FinishedAt, r.Status, r.Error = finishedAt.Time, status.String, runErr.String
+		r.Found, r.New, r.Terminated, r.Failed = int(found.Int64), int(added.Int64), int(terminated.Int64), int(failed.Int64)
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// RunAt returns the last run finished by a time, or, for an unfinished one,
+// started by then.  It returns false if there was no run yet.
+func (db *DB) RunAt(at time.Time) (int64, bool, error) {
+	rows, err := db.db.Query("SELECT ID, StartedAt, FinishedAt FROM Runs ORDER BY ID")
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var run int64
+	found := false
+	for rows.Next() {
+		var id int64
+		var startedAt time.Time
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&id, &startedAt, &finishedAt); err != nil {
+			return 0, false, err
+		}
+		done := startedAt
+		if finishedAt.Valid {
+			done = finishedAt.Time
+		}
+		if !done.After(at) {
+			run, found = id, true
+		}
+	}
+	return run, found, rows.Err()
+}
+
+// InstanceHistory returns what happened to an instance, oldest first.
+func (db *DB) InstanceHistory(ID string) ([]HistoryEntry, error) {
+	return db.queryHistory("WHERE InstanceID = ?", ID)
+}
+
+// HistoryBetween returns the history written by the runs after fromRun up
+// to and including toRun, or up to now if toRun is 0.
+func (db *DB) HistoryBetween(fromRun int64, toRun int64) ([]HistoryEntry, error) {
+	return db.queryHistory("WHERE RunID > ? AND (? = 0 OR RunID <= ?)", fromRun, toRun, toRun)
+}
+
+func (db *DB) queryHistory(where string, args ...any) ([]HistoryEntry, error) {
+	entries := make([]HistoryEntry, 0)
+	rows, err := db.db.Query(`
+	SELECT InstanceID, RunID, Time, Event, Field, Old, New
+	FROM History `+where+` ORDER BY Time, rowid`, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e HistoryEntry
+		var run sql.NullInt64
+		var field, old, new sql.NullString
+		if err := rows.Scan(&e.InstanceID, &run, &e.Time, &e.Event, &field, &old, &new); err != nil {
+			return entries, err
+		}
+		e.RunID, e.Field, e.Old, e.New = run.Int64, field.String, old.String, new.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -10,8 +10,10 @@ type Instance struct {
 	AMI           string            `yaml:"ami" json:"ami"`
 	CloudProvider string            `yaml:"cloud_provider" json:"cloud_provider"`
 	ENV           string            `yaml:"env" json:"env"`
+	FirstSeen     time.Time         `yaml:"first_seen" json:"first_seen"`
 	ID            string            `yaml:"id" json:"id"`
 	KeypairName   string            `yaml:"keypair_name" json:"keypair_name"`
+	LastSeen      time.Time         `yaml:"last_seen" json:"last_seen"`
 	LaunchTime    time.Time         `yaml:"launch_time" json:"launch_time"`
 	Name          string            `yaml:"name" json:"name"`
 	Notes         string            `yaml:"notes" json:"notes"`
@@ -26,6 +28,7 @@ type Instance struct {
 	State         string            `yaml:"state" json:"state"`
 	Subnet        string            `yaml:"subnet" json:"subnet"`
 	Tags          map[string]string `yaml:"tags" json:"tags"`
+	TerminatedAt  time.Time         `yaml:"terminated_at" json:"terminated_at"`
 	User          string            `yaml:"user" json:"user"`
 	VPC           string            `yaml:"vpc" json:"vpc"`
 }
@@ -1,33 +1,55 @@
 package inventoryengine
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path"
-	"regexp"
 	"strings"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/ascheel/goinventory/inventory/config"
 	"github.com/ascheel/goinventory/inventory/sshtest"
-	"github.com/op/go-logging"
 )
 
-var log            = logging.MustGetLogger("inventory")
+// ConfigFile is the settings file read by the engine.
+var ConfigFile     = "de_test.yml"
 
 type Inventory struct {
 	Instances map[string]Instance `yaml:"instances" json:"instances"`
 	Report struct {
 		terminated []string
 		new []string
+		// Known instances that were not running before this run.
+		started []string
 	}
 	Metadata struct {
 		Count map[string]int `yaml:"count" json:"count"`
 		Timestamp string `yaml:"timestamp" json:"timestamp"`
 	}
 	db *DB
+	config *config.Settings
+	keyPairs map[string]KeyPair
+	providers []Provider
+	scanned []ScopeResult
+	// SSH probes of the last run by sshtest.ErrorClass.
+	probes map[string]int
+	// Whether fact gathering could log in, by instance ID.
+	reachable map[string]bool
+	// Guards probes and reachable, which metrics read while a roll
+	// writes them.
+	probeMu sync.Mutex
+	timeouts Timeouts
+	// Narrows what Roll scans; set before the first roll.
+	Selection Selection
+	// Marks every missing instance terminated, whatever
+	// max_terminate_percent says.  Meant for a single roll.
+	ForceTerminate bool
 }
 
 var inv *Inventory
@@ -42,54 +64,231 @@ func NewInventory() *Inventory {
 	return inv
 }
 
-func (i *Inventory) Roll() error {
-	format           := logging.MustStringFormatter(`%{color}%{time:15:04:05.000} %{shortfile} ▶ %{level:.5s} %{id:03x}%{color:reset} %{message}`)
-	//format           := logging.MustStringFormatter(`%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level:.5s} %{id:03x}%{color:reset} %{message}`)
-	backend          := logging.NewLogBackend(os.Stderr, "", 0)
-	backendFormatter := logging.NewBackendFormatter(backend, format)
-	logging.SetBackend(backendFormatter)
-	logging.SetLevel(logging.DEBUG, "")
+func (i *Inventory) Config() *config.Settings {
+	if i.config == nil {
+		i.config = config.NewConfig(ConfigFile)
+	}
+	return i.config
+}
+
+// Providers returns the instance sources scanned by Roll.  Unless some were
+// added explicitly these are the clouds that have accounts configured, plus
+// static host files.  Each gets the Selection and narrows its own scan.
+func (i *Inventory) Providers() []Provider {
+	if i.providers == nil {
+		c := i.Config()
+		if len(c.AWS.Accounts) > 0 {
+			aws := NewAWS(c)
+			aws.Selection = i.Selection
+			i.providers = append(i.providers, aws)
+		}
+		if len(c.Azure.Accounts) > 0 {
+			azure := NewAzure(c)
+			azure.Selection = i.Selection
+			i.providers = append(i.providers, azure)
+		}
+		if len(c.Static.Sources) > 0 {
+			static := NewStatic(c)
+			static.Selection = i.Selection
+			i.providers = append(i.providers, static)
+		}
+	}
+	return i.providers
+}
+
+func (i *Inventory) AddProvider(p Provider) {
+	i.providers = append(i.Providers(), p)
+}
+
+// Roll refreshes the inventory.  If ctx is cancelled or the run times out,
+// what was found so far is kept and the run is recorded as partial.
+func (i *Inventory) Roll(ctx context.Context) error {
+	timeouts, err := RollTimeouts(i.Config())
+	if err != nil {
+		return err
+	}
+	i.timeouts = timeouts
+
+	// Only one roll at a time, whether from cron, by hand or the daemon.
+	lock, err := AcquireLock(i.Datadir())
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// Start from scratch; the inventory may be rolled more than once.
+	i.Instances = make(map[string]Instance)
+	i.Report.new, i.Report.terminated, i.Report.started = nil, nil, nil
+	i.scanned = nil
+	i.resetProbes()
+
+	run := Run{StartedAt: time.Now()}
+	run.ID, err = i.db.StartRun(run.StartedAt)
+	if err != nil {
+		slog.Error("Unable to record run", "err", err)
+	}
+	// Everything logged from here on carries the run ID.
+	ctx = WithLogAttrs(ctx, "run", run.ID)
+	if timeouts.Run > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeouts.Run, fmt.Errorf("run timed out after %s", timeouts.Run))
+		defer cancel()
+	}
+
+	err = i.roll(ctx)
+	cutShort := ctx.Err() != nil
+	if cutShort {
+		err = fmt.Errorf("roll stopped early: %w", context.Cause(ctx))
+		slog.WarnContext(ctx, "Roll stopped early, keeping what was found", "err", context.Cause(ctx))
+	}
+	// Bookkeeping still happens for a run that was cut short.
+	ctx = context.WithoutCancel(ctx)
+
+	run.FinishedAt = time.Now()
+	run.Status = "ok"
+	run.Found, run.New, run.Terminated = len(i.Instances), len(i.Report.new), len(i.Report.terminated)
+	for _, result := range i.scanned {
+		if result.Err != nil {
+			run.Failed++
+		}
+	}
+	if cutShort {
+		run.Status, run.Error = "partial", err.Error()
+	} else if err != nil {
+		run.Status, run.Error = "failed", err.Error()
+	} else if run.Failed > 0 {
+		run.Status = "partial"
+	}
+	if run.ID != 0 {
+		if err := i.db.FinishRun(run); err != nil {
+			slog.ErrorContext(ctx, "Unable to record run", "err", err)
+		}
+	}
+	if err := i.db.RecordScans(i.scanned, run.StartedAt); err != nil {
+		slog.ErrorContext(ctx, "Unable to record scans", "err", err)
+	}
+	if err := i.Notify(run.ID); err != nil {
+		slog.ErrorContext(ctx, "Notifications failed", "err", err)
+	}
+	if _, err := i.BackupDB(run.ID, run.FinishedAt); err != nil {
+		slog.ErrorContext(ctx, "Unable to back up the database", "err", err)
+	}
+	if file := i.Config().Inventory.MetricsFile; file != "" {
+		if err := i.WriteMetricsFile(file); err != nil {
+			slog.ErrorContext(ctx, "Unable to write metrics", "err", err)
+		}
+	}
+	return err
+}
 
-	// Now get current state from AWS.
-	i.ReadInventoryFromAWS()
+func (i *Inventory) roll(ctx context.Context) error {
+	// Now get current state from every provider.
+	err := phase(ctx, "scan", i.timeouts.Scan, i.ReadInventory)
+	if err != nil {
+		return err
+	}
 
-	// Now check which instances are gone.
-	i.MarkTerminated()
+	// Find logins for instances we haven't seen before.
+	if ctx.Err() == nil {
+		phase(ctx, "logins", i.timeouts.Logins, i.AddNew)
+	}
+
+	// Collect facts from every host we can log in to.
+	if ctx.Err() == nil {
+		phase(ctx, "facts", i.timeouts.Facts, func(ctx context.Context) error {
+			i.GatherAllFacts(ctx)
+			return nil
+		})
+	}
+
+	// Now check which instances are gone.  Scopes that finished scanning
+	// count even if the run was cut short afterwards.
+	terminateErr := i.MarkTerminated(context.WithoutCancel(ctx))
+	if terminateErr != nil {
+		slog.ErrorContext(ctx, terminateErr.Error())
+	}
 
 	// Now export the results to a file.
-	i.ExportToFile()
+	i.ExportToFile(ctx)
 
-	return nil
+	return terminateErr
 }
 
-func (i *Inventory) MarkTerminated() error {
-	log.Debug("Marking terminated.")
+// DefaultMaxTerminatePercent applies when max_terminate_percent isn't set.
+const DefaultMaxTerminatePercent = 25
+
+// AlwaysTerminate is how many instances of a scope may be marked terminated
+// in one run whatever their share, so small scopes aren't stuck.
+const AlwaysTerminate = 2
+
+func (i *Inventory) MarkTerminated(ctx context.Context) error {
+	slog.DebugContext(ctx, "Marking terminated.")
 	// Find instances that no longer exist and change their state to "terminated"
 
-	// 1) Get AWS instances
-	// 2) Get database instances that are not terminated
-	// 3) Any from DB that do not exist in AWS instances, flag as terminated
+	// 1) Get the scopes that were scanned successfully this run
+	// 2) Get database instances in those scopes that are not terminated
+	// 3) Any of those not seen this run, flag as terminated, scope by scope
 
-	// Currently on AWS
-	a := NewAWS()
-	instances := a.GetInstanceList()
+	scopes := make([]Scope, 0)
+	for _, result := range i.scanned {
+		if result.Err == nil {
+			scopes = append(scopes, result.Scope)
+		}
+	}
 
 	// Currently in Database
-	notTerminated, err := i.db.GetActiveInstances()
+	notTerminated, err := i.db.ListInstances()
 	if err != nil {
 		return err
 	}
 
-	// Now compare and flag.
+	// Now compare, per scope.
+	inScope := make(map[Scope]int)
+	missing := make(map[Scope][]string)
+	for _, instance := range notTerminated {
+		n := slices.IndexFunc(scopes, func(s Scope) bool { return s.Covers(instance) })
+		if n < 0 {
+			continue
+		}
+		inScope[scopes[n]]++
+		if _, seen := i.Instances[instance.ID]; !seen {
+			missing[scopes[n]] = append(missing[scopes[n]], instance.ID)
+		}
+	}
+
+	// An API returning nothing looks exactly like everything being gone.
+	limit := i.Config().Inventory.MaxTerminatePercent
+	if limit <= 0 {
+		limit = DefaultMaxTerminatePercent
+	}
 	needsMarked := make([]string, 0)
-	for _, id1 := range notTerminated {
-		if ! slices.Contains[[]string, string](instances, id1) {
-			needsMarked = append(needsMarked, id1)
+	var refused []error
+	for _, scope := range scopes {
+		ids := missing[scope]
+		if len(ids) == 0 {
+			continue
 		}
+		if !i.ForceTerminate && len(ids) > AlwaysTerminate && len(ids)*100 > inScope[scope]*limit {
+			refused = append(refused, fmt.Errorf("refusing to mark %d of %d instances in %s terminated (max_terminate_percent is %d, roll with -force-terminate to mark them anyway)",
+				len(ids), inScope[scope], scope, limit))
+			continue
+		}
+		needsMarked = append(needsMarked, ids...)
+		// A scope reported twice is only marked once.
+		delete(missing, scope)
+	}
+	if len(needsMarked) == 0 {
+		return errors.Join(refused...)
 	}
-	i.db.FlagInstancesAsTerminated(needsMarked)
 
-	return nil
+	slog.InfoContext(ctx, "Marking instances terminated", "count", len(needsMarked), "instances", strings.Join(needsMarked, ", "))
+	err = i.db.FlagInstancesAsTerminated(ctx, needsMarked)
+	if err != nil {
+		return err
+	}
+	i.Report.terminated = append(i.Report.terminated, needsMarked...)
+
+	return errors.Join(refused...)
 }
 
 func DirExists(dirname string) bool {
@@ -108,26 +307,33 @@ func CreateDirIfNotExists(dirname string) error {
 	return err
 }
 
-func (i *Inventory) GetKeys() []string {
+func (i *Inventory) GetKeys(ctx context.Context) []string {
 	var keys []string
+	c := i.Config()
 	homedir, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatal("Unable to get home directory.")
-		os.Exit(1)
+		fatal("Unable to get home directory.", "err", err)
 	}
 	sshdir := path.Join(homedir, "ansible", "keys")
 	
 	// Create SSH Dir if not exists
 	err = CreateDirIfNotExists(sshdir)
 	if err != nil {
-		log.Fatalf("Unable to create ssh dir: %v\n", err)
+		fatal("Unable to create ssh dir", "dir", sshdir, "err", err)
 	}
 
 	files := GetFiles(sshdir)
+	for _, file := range c.Inventory.Keys {
+		files = append(files, config.ParseTilde(file))
+	}
 	for _, file := range files {
+		if slices.Contains(keys, file) || isBlacklisted(c, file) {
+			continue
+		}
 		result, err := IsPrivateKeyFile(file)
 		if err != nil {
-			log.Fatalf("Unable to determine if a file is a private key: %v\n", err)
+			slog.WarnContext(ctx, "Skipping unreadable key file", "file", file, "err", err)
+			continue
 		}
 		if result {
 			keys = append(keys, file)
@@ -137,103 +343,186 @@ func (i *Inventory) GetKeys() []string {
 }
 
 func IsPrivateKeyFile(filename string) (bool, error) {
-	shortname := path.Base(filename)
-	pattern := `id_{dsa|rsa|ecdsa|ed25519}.*`
-	matched, err := regexp.MatchString(pattern, shortname)
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return false, err
 	}
-	return matched, nil
+	return strings.Contains(string(data), "PRIVATE KEY-----"), nil
 }
 
 func GetFiles(dirname string) []string {
 	var files []string
 	entries, err := os.ReadDir(dirname)
 	if err != nil {
-		log.Fatalf("Unable to read directory %s: %v\n", err)
+		fatal("Unable to read directory", "dir", dirname, "err", err)
 	}
 
 	for _, file := range entries {
 		if !file.IsDir() {
-			files = append(files, file.Name())
+			files = append(files, path.Join(dirname, file.Name()))
 		}
 	}
 	return files
 }
 
-func (i *Inventory) AddNew() error {
-	// Add basic data to i.Instances
-	a := NewAWS()
-	for key, instance := range a.Instances {
-		_, ok := i.Instances[key]
-		if ok {
-			// Key does exist.  It's not new.
-			continue
-		} else {
-			// Key does not yet exist.  Add it.
-			i.Instances[key] = instance
-			i.Report.new = append(i.Report.new, key)
-		}
-	}
+func (i *Inventory) AddNew(ctx context.Context) error {
 	// Populate login details, if known.
-	c := config.Settings{}
+	c := i.Config()
 	users := c.Inventory.Users
-	sshkeys := i.GetKeys()
-	fmt.Printf("Found SSH keys: %s\n", strings.Join(sshkeys, ", "))
-
-	for _, instanceId := range i.Report.new {
-		instance := a.Instances[instanceId]
-		// ip_public := instance.PublicIP
-		// ip_private := instance.PrivateIP
+	sshkeys := i.GetKeys(ctx)
+	slog.InfoContext(ctx, "Found SSH keys", "keys", strings.Join(sshkeys, ", "))
+	resolver := NewKeyResolver(ctx, c, sshkeys, i.keyPairs)
+
+	// Instances that were stopped when first seen get another try once
+	// they run.
+	for _, instanceId := range append(slices.Clone(i.Report.new), i.Report.started...) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		instance := i.Instances[instanceId]
+		ctx := WithLogAttrs(ctx, "instance", instanceId)
+		if instance.User != "" && instance.SSHKey != "" {
+			continue
+		}
+		if user, key, _, err := i.db.GetLogin(instanceId); err == nil && user != "" && key != "" {
+			continue
+		}
+		if instance.State != "running" {
+			slog.DebugContext(ctx, "Skipping instance that isn't running", "state", instance.State)
+			continue
+		}
 		address, err := instance.GetConnectionAddress()
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping instance", "err", err)
+			continue
+		}
 		port := instance.GetPort()
 
-		if err != nil {
-			panic("Failure getting address.")
-		}
-		for _, user := range users {
-			conn := sshtest.ConnectionInfo {
-				Host: address,
-				User: user,
-				Port: port,
-				Key: instance.SSHKey,
-			}
-			fmt.Println("Test")
-			result := conn.TryConnect()
-			if result {
-				// SUCCESS!
-				// First we get a copy of the map
-				if entry, ok := i.Instances[instanceId]; ok {
-					entry.User = user
-					entry.SSHPort = port
-					entry.SSHKey = instance.SSHKey
+		keys := resolver.Candidates(instance)
+		if len(keys) == 0 {
+			slog.WarnContext(ctx, "No key", "keypair", instance.KeypairName)
+			continue
+		}
+		tryUsers := users
+		if instance.User != "" {
+			tryUsers = []string{instance.User}
+		}
+		found := false
+		for _, key := range keys {
+			for _, user := range tryUsers {
+				conn := sshtest.ConnectionInfo {
+					Host: address,
+					User: user,
+					Port: port,
+					Key: key,
+					Timeout: i.timeouts.SSH,
+				}
+				slog.DebugContext(ctx, "Trying login", "user", user, "address", address, "key", key)
+				ok := conn.TryConnectContext(ctx)
+				if ctx.Err() != nil {
+					return ctx.Err()
 				}
+				i.recordProbe(conn.ErrRaw)
+				if ok {
+					// SUCCESS!
+					instance.User = user
+					instance.SSHPort = port
+					instance.SSHKey = key
+					i.Instances[instanceId] = instance
+					if err := i.db.SetLogin(ctx, instanceId, user, key, port); err != nil {
+						slog.ErrorContext(ctx, "Unable to store login", "err", err)
+					}
+					found = true
+					break
+				}
+			}
+			if found {
+				break
 			}
 		}
+		if !found {
+			slog.WarnContext(ctx, "Unable to log in")
+		}
 	}
 	return nil
 }
 
-func (i *Inventory) ExportToFile() error {
+func (i *Inventory) ExportToFile(ctx context.Context) error {
 	// Now do the exporty stuff.
-	log.Debug("Exporting to file (not yet implemented).")
+	slog.DebugContext(ctx, "Exporting to file (not yet implemented).")
 	return nil
 }
 
-func (i *Inventory) AddInstancesToDB(instances map[string]Instance) {
-	log.Debug("Adding instances to DB.")
-	for instanceID, instance := range instances {
-		log.Debugf("Adding %s to db\n", instanceID)
-		i.db.AddOrUpdateInstance(instance)
+// AddInstancesToDB stores a scan in a single transaction, so a failure
+// leaves the database as it was.
+func (i *Inventory) AddInstancesToDB(ctx context.Context, instances map[string]Instance) error {
+	slog.DebugContext(ctx, "Adding instances to DB.")
+	previous, err := i.db.ListAllInstances()
+	if err != nil {
+		return err
 	}
+	stopped := make(map[string]bool)
+	for _, instance := range previous {
+		stopped[instance.ID] = instance.State != "running"
+	}
+	batch := make([]Instance, 0, len(instances))
+	for _, instance := range instances {
+		batch = append(batch, instance)
+		if instance.State == "running" && stopped[instance.ID] {
+			i.Report.started = append(i.Report.started, instance.ID)
+		}
+	}
+	newIDs, err := i.db.UpsertInstances(ctx, batch, time.Now())
+	if err != nil {
+		return err
+	}
+	i.Report.new = append(i.Report.new, newIDs...)
+	return nil
 }
 
-func (i *Inventory) ReadInventoryFromAWS() {
-	log.Debug("Reading inventory from AWS.")
-	a := NewAWS()
-	instances := a.GetInstances()
-	i.AddInstancesToDB(instances)
-	//a.AddInstancesToDB()
+// ReadInventory runs every provider and stores what they found.  Scopes that
+// fail are logged and left out of termination; missing credentials are an
+// error unless skip_on_no_creds is set.
+func (i *Inventory) ReadInventory(ctx context.Context) error {
+	if i.Instances == nil {
+		i.Instances = make(map[string]Instance)
+	}
+	if i.keyPairs == nil {
+		i.keyPairs = make(map[string]KeyPair)
+	}
+
+	var credErr error
+	found := make(map[string]Instance)
+	for _, p := range i.Providers() {
+		slog.DebugContext(ctx, "Reading inventory", "provider", p.Name())
+		instances, results := p.Discover(ctx)
+
+		for _, instance := range instances {
+			found[instance.ID] = instance
+			i.Instances[instance.ID] = instance
+		}
+		for _, result := range results {
+			if errors.Is(result.Err, ErrNoCredentials) {
+				if i.Config().Inventory.SkipOnNoCreds {
+					slog.WarnContext(ctx, "Skipping scope", "scope", result.Scope.String(), "err", result.Err)
+				} else {
+					credErr = result.Err
+				}
+			}
+		}
+		i.scanned = append(i.scanned, results...)
+
+		if source, ok := p.(KeyPairSource); ok {
+			for k, v := range source.KeyPairs() {
+				i.keyPairs[k] = v
+			}
+		}
+	}
+	// Whatever was found is stored even if the scan was cut short.
+	if err := i.AddInstancesToDB(context.WithoutCancel(ctx), found); err != nil {
+		return err
+	}
+	return credErr
 }
 
 func (i *Inventory) PrettyPrintInventory() error {
@@ -246,6 +535,5 @@ func (i *Inventory) PrettyPrintInventory() error {
 }
 
 func LogAndQuit(text string, err error) {
-	msg := fmt.Sprintf("%s: %v\n", text, err)
-	log.Fatal(msg)
+	fatal(text, "err", err)
 }
@@ -0,0 +1,119 @@
+package inventoryengine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkTerminated(t *testing.T) {
+	ctx := context.Background()
+	small := Scope{Provider: "aws", Account: "dev", Region: "us-east-1"}
+	big := Scope{Provider: "aws", Account: "prod", Region: "us-east-1"}
+
+	setup := func(t *testing.T) *Inventory {
+		inv := testInventory(t, testSettings(t, "{}"))
+		stored := make([]Instance, 0)
+		for n := 0; n < 3; n++ {
+			stored = append(stored, Instance{ID: fmt.Sprintf("dev-%d", n), CloudProvider: "aws", Account: "dev", Region: "us-east-1", State: "running"})
+		}
+		for n := 0; n < 10; n++ {
+			stored = append(stored, Instance{ID: fmt.Sprintf("prod-%d", n), CloudProvider: "aws", Account: "prod", Region: "us-east-1", State: "running"})
+		}
+		if _, err := inv.db.UpsertInstances(ctx, stored, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		// This run dev-0 and half of prod are gone.
+		inv.Instances = make(map[string]Instance)
+		for _, instance := range stored {
+			if instance.ID != "dev-0" && !(instance.Account == "prod" && instance.ID >= "prod-5") {
+				inv.Instances[instance.ID] = instance
+			}
+		}
+		inv.scanned = []ScopeResult{{Scope: small}, {Scope: big}}
+		return inv
+	}
+
+	t.Run("per scope", func(t *testing.T) {
+		inv := setup(t)
+		err := inv.MarkTerminated(ctx)
+		// One of three is a third of dev, but few enough to always go.
+		if !slices.Equal(inv.Report.terminated, []string{"dev-0"}) {
+			t.Errorf("terminated = %q, want dev-0 only", inv.Report.terminated)
+		}
+		if err == nil || !strings.Contains(err.Error(), "5 of 10 instances in aws/prod/us-east-1") {
+			t.Errorf("err = %v, want prod refused", err)
+		}
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		inv := setup(t)
+		inv.ForceTerminate = true
+		if err := inv.MarkTerminated(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(inv.Report.terminated) != 6 {
+			t.Errorf("terminated = %q, want all six", inv.Report.terminated)
+		}
+		remaining, err := inv.db.ListInstances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(remaining) != 7 {
+			t.Errorf("%d instances left active, want 7", len(remaining))
+		}
+	})
+
+	t.Run("failed scope", func(t *testing.T) {
+		inv := setup(t)
+		inv.scanned = []ScopeResult{{Scope: small, Err: fmt.Errorf("throttled")}, {Scope: big, Err: fmt.Errorf("throttled")}}
+		if err := inv.MarkTerminated(ctx); err != nil || len(inv.Report.terminated) != 0 {
+			t.Errorf("err = %v, terminated = %q", err, inv.Report.terminated)
+		}
+	})
+}
+
+func TestProvidersSelection(t *testing.T) {
+	inv := testInventory(t, testSettings(t, `
+aws:
+  accounts:
+    prod: {accountno: "123456789012"}
+azure:
+  accounts:
+    prod: {id: sub}
+static:
+  sources: [hosts.yml]
+`))
+	inv.Selection = Selection{Regions: []string{"use1"}, Envs: []string{"prod"}}
+	names := make([]string, 0)
+	for _, p := range inv.Providers() {
+		names = append(names, p.Name())
+	}
+	if !slices.Equal(names, []string{"aws", "azure", "static"}) {
+		t.Errorf("providers = %v, want every configured one", names)
+	}
+}
+
+func TestAddInstancesToDBStarted(t *testing.T) {
+	ctx := context.Background()
+	inv := testInventory(t, testSettings(t, "{}"))
+	stopped := Instance{ID: "i-1", State: "stopped"}
+	if err := inv.AddInstancesToDB(ctx, map[string]Instance{"i-1": stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(inv.Report.new, []string{"i-1"}) || len(inv.Report.started) != 0 {
+		t.Fatalf("first scan: new %v, started %v", inv.Report.new, inv.Report.started)
+	}
+
+	inv.Report.new = nil
+	running := Instance{ID: "i-1", State: "running"}
+	if err := inv.AddInstancesToDB(ctx, map[string]Instance{"i-1": running}); err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Report.new) != 0 || !slices.Equal(inv.Report.started, []string{"i-1"}) {
+		t.Errorf("after start: new %v, started %v", inv.Report.new, inv.Report.started)
+	}
+}
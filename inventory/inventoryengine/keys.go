@@ -0,0 +1,189 @@
+package inventoryengine
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ascheel/goinventory/inventory/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPair is an EC2 key pair as reported by DescribeKeyPairs.
+type KeyPair struct {
+	Name        string
+	Fingerprint string
+	PublicKey   string
+}
+
+func KeyPairScope(account string, region string, name string) string {
+	return account + "/" + region + "/" + name
+}
+
+// KeyResolver maps the EC2 KeypairName of an instance to local private key
+// files, either through the key_map setting or by comparing fingerprints.
+type KeyResolver struct {
+	keys         []string
+	fingerprints map[string][]string
+	keyPairs     map[string]KeyPair
+	keyMap       map[string]string
+	explicit     bool
+}
+
+func NewKeyResolver(ctx context.Context, c *config.Settings, keys []string, keyPairs map[string]KeyPair) *KeyResolver {
+	r := &KeyResolver{
+		keys:         make([]string, 0),
+		fingerprints: make(map[string][]string),
+		keyPairs:     keyPairs,
+		keyMap:       make(map[string]string),
+		explicit:     c.Inventory.ExplicitKeys,
+	}
+	for name, file := range c.Inventory.KeyMap {
+		file = config.ParseTilde(file)
+		if _, err := KeyFingerprints(file); err != nil {
+			slog.WarnContext(ctx, "Skipping key_map entry", "keypair", name, "key", file, "err", err)
+			continue
+		}
+		r.keyMap[name] = file
+	}
+	for _, key := range keys {
+		fingerprints, err := KeyFingerprints(key)
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping key", "key", key, "err", err)
+			continue
+		}
+		r.keys = append(r.keys, key)
+		r.fingerprints[key] = fingerprints
+	}
+	return r
+}
+
+// Match returns the local key file belonging to the instance's key pair.
+func (r *KeyResolver) Match(instance Instance) (string, bool) {
+	if instance.KeypairName == "" {
+		return "", false
+	}
+	if file, ok := r.keyMap[instance.KeypairName]; ok {
+		return file, true
+	}
+	kp, ok := r.keyPairs[KeyPairScope(instance.Account, instance.Region, instance.KeypairName)]
+	if !ok {
+		return "", false
+	}
+	wanted := make([]string, 0)
+	if kp.Fingerprint != "" {
+		wanted = append(wanted, normalizeFingerprint(kp.Fingerprint))
+	}
+	if kp.PublicKey != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kp.PublicKey))
+		if err == nil {
+			wanted = append(wanted, normalizeFingerprint(ssh.FingerprintSHA256(pub)))
+		}
+	}
+	for _, key := range r.keys {
+		for _, fp := range r.fingerprints[key] {
+			for _, w := range wanted {
+				if fp == w {
+					return key, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// Candidates returns the keys to try for an instance in order.  The matching
+// key comes first; with explicit_keys set it is the only candidate.
+func (r *KeyResolver) Candidates(instance Instance) []string {
+	if instance.SSHKey != "" {
+		return []string{instance.SSHKey}
+	}
+	match, ok := r.Match(instance)
+	if r.explicit {
+		if ok {
+			return []string{match}
+		}
+		return []string{}
+	}
+	candidates := make([]string, 0, len(r.keys)+1)
+	if ok {
+		candidates = append(candidates, match)
+	}
+	for _, key := range r.keys {
+		if key != match {
+			candidates = append(candidates, key)
+		}
+	}
+	return candidates
+}
+
+// KeyFingerprints computes every fingerprint format EC2 may report for a
+// private key: MD5 of the DER public key (imported keys), SHA-1 of the PKCS#8
+// private key (AWS-created RSA keys) and SHA-256 of the public key (ED25519).
+func KeyFingerprints(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := raw.(*ed25519.PrivateKey); ok {
+		raw = *k
+	}
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	pub := signer.PublicKey()
+
+	fingerprints := []string{
+		normalizeFingerprint(ssh.FingerprintSHA256(pub)),
+		normalizeFingerprint(ssh.FingerprintLegacyMD5(pub)),
+	}
+	if cryptoPub, ok := pub.(ssh.CryptoPublicKey); ok {
+		if der, err := x509.MarshalPKIXPublicKey(cryptoPub.CryptoPublicKey()); err == nil {
+			sum := md5.Sum(der)
+			fingerprints = append(fingerprints, colonHex(sum[:]))
+		}
+	}
+	if der, err := x509.MarshalPKCS8PrivateKey(raw); err == nil {
+		sum := sha1.Sum(der)
+		fingerprints = append(fingerprints, colonHex(sum[:]))
+	}
+	return fingerprints, nil
+}
+
+func colonHex(sum []byte) string {
+	parts := make([]string, 0, len(sum))
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(fingerprint, "SHA256:")
+	fingerprint = strings.TrimRight(fingerprint, "=")
+	if strings.Contains(fingerprint, ":") {
+		fingerprint = strings.ToLower(fingerprint)
+	}
+	return fingerprint
+}
+
+func isBlacklisted(c *config.Settings, filename string) bool {
+	for _, entry := range c.Inventory.KeyBlacklist {
+		if entry == path.Base(filename) || config.ParseTilde(entry) == filename {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+package inventoryengine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// sudoersCommand prints sudoers and every file in sudoers.d.
+const sudoersCommand = "sudo -n sh -c 'cat /etc/sudoers && { find /etc/sudoers.d -type f -exec cat {} + 2>/dev/null; true; }'"
+
+// LdapFacts reads the directory join and login access configuration of a
+// host: sssd.conf, realmd and sudoers.  Everything is looked up on the host
+// itself so no LDAP server is contacted.
+type LdapFacts struct{}
+
+func (LdapFacts) Name() string { return "ldap" }
+
+func (LdapFacts) Gather(ctx context.Context, r Runner, instance Instance, c *config.Settings) (map[string]string, error) {
+	facts := make(map[string]string)
+
+	realms, err := runTrimmed(r, "realm list --name-only 2>/dev/null")
+	if err == nil {
+		facts["realms"] = strings.Join(strings.Fields(realms), ",")
+	}
+
+	// sssd.conf is only readable by root.
+	sssd, err := r.Run("sudo -n cat /etc/sssd/sssd.conf")
+	if err == nil {
+		conf := ParseSSSDConf(sssd)
+		facts["domains"] = strings.Join(conf.Domains, ",")
+		facts["access_provider"] = strings.Join(conf.AccessProviders, ",")
+		facts["allow_groups"] = strings.Join(conf.AllowGroups, ",")
+	}
+
+	// An empty sudoers.d is fine; only an unreadable sudoers is a failure.
+	sudoers, err := r.Run(sudoersCommand)
+	if err == nil {
+		facts["sudo_groups"] = strings.Join(ParseSudoersGroups(sudoers), ",")
+	}
+	return facts, nil
+}
+
+// SSSDConf is the part of sssd.conf that decides who may log in.
+type SSSDConf struct {
+	Domains         []string
+	AccessProviders []string
+	AllowGroups     []string
+}
+
+func ParseSSSDConf(contents string) SSSDConf {
+	conf := SSSDConf{
+		Domains:         make([]string, 0),
+		AccessProviders: make([]string, 0),
+		AllowGroups:     make([]string, 0),
+	}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		switch {
+		case section == "sssd" && k == "domains":
+			conf.Domains = append(conf.Domains, splitList(v)...)
+		case strings.HasPrefix(section, "domain/") && k == "access_provider":
+			conf.AccessProviders = append(conf.AccessProviders, v)
+		case strings.HasPrefix(section, "domain/") && k == "simple_allow_groups":
+			conf.AllowGroups = append(conf.AllowGroups, splitList(v)...)
+		}
+	}
+	return conf
+}
+
+// ParseSudoersGroups returns the groups granted rules in sudoers ("%group").
+func ParseSudoersGroups(contents string) []string {
+	groups := make([]string, 0)
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "%") {
+			continue
+		}
+		// Group names may contain escaped spaces: %domain\ admins ALL=...
+		name := strings.Builder{}
+		for n := 1; n < len(line); n++ {
+			if line[n] == '\\' && n+1 < len(line) {
+				n++
+				name.WriteByte(line[n])
+				continue
+			}
+			if line[n] == ' ' || line[n] == '\t' {
+				break
+			}
+			name.WriteByte(line[n])
+		}
+		group := strings.Trim(name.String(), `"`)
+		if group != "" && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// normalizeGroup drops a domain qualifier so that "admins@corp.example.com"
+// matches "admins".
+func normalizeGroup(group string) string {
+	group, _, _ = strings.Cut(strings.ToLower(group), "@")
+	return group
+}
+
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if normalizeGroup(g) == normalizeGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// LdapAccess is the result of checking one instance against the directory
+// settings of its account.
+type LdapAccess struct {
+	ID          string    `yaml:"id" json:"id"`
+	Name        string    `yaml:"name" json:"name"`
+	Account     string    `yaml:"account" json:"account"`
+	Reachable   bool      `yaml:"reachable" json:"reachable"`
+	Domain      string    `yaml:"domain" json:"domain"`
+	Joined      bool      `yaml:"joined" json:"joined"`
+	NoLogin     []string  `yaml:"no_login" json:"no_login"`
+	NoSudo      []string  `yaml:"no_sudo" json:"no_sudo"`
+	CollectedAt time.Time `yaml:"collected_at" json:"collected_at"`
+	Problems    []string  `yaml:"problems" json:"problems"`
+}
+
+// RequiredLdapGroups is ssh.ldap_groups plus the comma separated "groups"
+// entry of the account's ldap settings.
+func RequiredLdapGroups(c *config.Settings, account string) []string {
+	groups := slices.Clone(c.SSH.LdapGroups)
+	for _, group := range splitList(c.AWS.Accounts[account].LDAP["groups"]) {
+		if !containsGroup(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// CheckLdap compares the ldap facts of an instance with the "domain" entry of
+// its account's ldap settings and the required groups.
+func CheckLdap(c *config.Settings, instance Instance, facts map[string]string, collectedAt time.Time) LdapAccess {
+	result := LdapAccess{
+		ID:          instance.ID,
+		Name:        instance.Name,
+		Account:     instance.Account,
+		Domain:      c.AWS.Accounts[instance.Account].LDAP["domain"],
+		NoLogin:     make([]string, 0),
+		NoSudo:      make([]string, 0),
+		CollectedAt: collectedAt,
+		Problems:    make([]string, 0),
+	}
+	if len(facts) == 0 {
+		result.Problems = append(result.Problems, "unreachable")
+		return result
+	}
+	result.Reachable = true
+
+	_, sssdKnown := facts["ldap.domains"]
+	_, sudoKnown := facts["ldap.sudo_groups"]
+	domains := append(splitList(facts["ldap.domains"]), splitList(facts["ldap.realms"])...)
+	if result.Domain == "" {
+		result.Joined = len(domains) > 0
+	} else {
+		for _, d := range domains {
+			if strings.EqualFold(d, result.Domain) {
+				result.Joined = true
+			}
+		}
+	}
+	if !result.Joined {
+		if !sssdKnown && facts["ldap.realms"] == "" {
+			result.Problems = append(result.Problems, "sssd.conf unreadable")
+		} else if result.Domain == "" {
+			result.Problems = append(result.Problems, "not joined to a directory")
+		} else {
+			result.Problems = append(result.Problems, fmt.Sprintf("not joined to %s", result.Domain))
+		}
+	}
+
+	simple := slices.Contains(splitList(facts["ldap.access_provider"]), "simple")
+	allowed := splitList(facts["ldap.allow_groups"])
+	sudoGroups := splitList(facts["ldap.sudo_groups"])
+	for _, group := range RequiredLdapGroups(c, instance.Account) {
+		if simple && !containsGroup(allowed, group) {
+			result.NoLogin = append(result.NoLogin, group)
+		}
+		if sudoKnown && !containsGroup(sudoGroups, group) {
+			result.NoSudo = append(result.NoSudo, group)
+		}
+	}
+	if len(result.NoLogin) > 0 {
+		result.Problems = append(result.Problems, "login denied: "+strings.Join(result.NoLogin, ","))
+	}
+	if len(result.NoSudo) > 0 {
+		result.Problems = append(result.Problems, "no sudo: "+strings.Join(result.NoSudo, ","))
+	}
+	if !sudoKnown {
+		result.Problems = append(result.Problems, "sudoers unreadable")
+	}
+	return result
+}
+
+// LdapReport checks every running instance in the database.
+func (i *Inventory) LdapReport() ([]LdapAccess, error) {
+	c := i.Config()
+	instances, err := i.db.ListInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]LdapAccess, 0)
+	for _, instance := range instances {
+		if instance.State != "running" {
+			continue
+		}
+		facts, collectedAt, err := i.db.GetFacts(instance.ID)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, CheckLdap(c, instance, facts, collectedAt))
+	}
+	return results, nil
+}
+
+// WriteLdapReport renders the results as "table" or "json".  Unless all is
+// set only instances with mismatches are listed.
+func WriteLdapReport(w io.Writer, results []LdapAccess, format string, all bool) error {
+	if !all {
+		mismatched := make([]LdapAccess, 0)
+		for _, r := range results {
+			if len(r.Problems) > 0 {
+				mismatched = append(mismatched, r)
+			}
+		}
+		results = mismatched
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(results)
+	case "table", "":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tID\tNAME\tDOMAIN\tJOINED\tPROBLEMS")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\n", r.Account, r.ID, r.Name, r.Domain, r.Joined, strings.Join(r.Problems, "; "))
+	}
+	return tw.Flush()
+}
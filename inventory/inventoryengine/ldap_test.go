@@ -0,0 +1,170 @@
+package inventoryengine
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeRunner answers commands from a table; anything else fails as a
+// command that is not installed would.
+type fakeRunner map[string]string
+
+func (f fakeRunner) Run(command string) (string, error) {
+	if output, ok := f[command]; ok {
+		return output, nil
+	}
+	return "", errors.New("exit status 1")
+}
+
+const testSSSDConf = `
+[sssd]
+services = nss, pam
+domains = corp.example.com
+
+; comments are ignored
+[domain/corp.example.com]
+id_provider = ad
+access_provider = simple
+simple_allow_groups = linux-admins, Developers@corp.example.com
+`
+
+const testSudoers = `
+Defaults	env_reset
+root	ALL=(ALL:ALL) ALL
+%sudo	ALL=(ALL:ALL) ALL
+# %commented ALL=(ALL) ALL
+%linux-admins ALL=(ALL) NOPASSWD: ALL
+%domain\ admins ALL=(ALL) ALL
+`
+
+func TestParseSSSDConf(t *testing.T) {
+	conf := ParseSSSDConf(testSSSDConf)
+	if !slices.Equal(conf.Domains, []string{"corp.example.com"}) {
+		t.Errorf("domains = %q", conf.Domains)
+	}
+	if !slices.Equal(conf.AccessProviders, []string{"simple"}) {
+		t.Errorf("access providers = %q", conf.AccessProviders)
+	}
+	if !slices.Equal(conf.AllowGroups, []string{"linux-admins", "Developers@corp.example.com"}) {
+		t.Errorf("allow groups = %q", conf.AllowGroups)
+	}
+}
+
+func TestParseSudoersGroups(t *testing.T) {
+	groups := ParseSudoersGroups(testSudoers)
+	if want := []string{"sudo", "linux-admins", "domain admins"}; !slices.Equal(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+}
+
+func TestLdapFacts(t *testing.T) {
+	c := testSettings(t, `
+ssh:
+  ldap_groups: [linux-admins]
+aws:
+  accounts:
+    prod:
+      ldap:
+        domain: corp.example.com
+        groups: developers
+`)
+	instance := Instance{ID: "i-1", Account: "prod"}
+
+	tests := []struct {
+		name     string
+		runner   fakeRunner
+		facts    map[string]string
+		joined   bool
+		problems []string
+	}{
+		{
+			name: "joined with access",
+			runner: fakeRunner{
+				"realm list --name-only 2>/dev/null": "corp.example.com\n",
+				"sudo -n cat /etc/sssd/sssd.conf":    testSSSDConf,
+				sudoersCommand:                       testSudoers + "%developers ALL=(ALL) ALL\n",
+			},
+			facts: map[string]string{
+				"realms":          "corp.example.com",
+				"domains":         "corp.example.com",
+				"access_provider": "simple",
+				"allow_groups":    "linux-admins,Developers@corp.example.com",
+				"sudo_groups":     "sudo,linux-admins,domain admins,developers",
+			},
+			joined:   true,
+			problems: []string{},
+		},
+		{
+			name: "missing sudo rule",
+			runner: fakeRunner{
+				"sudo -n cat /etc/sssd/sssd.conf": testSSSDConf,
+				sudoersCommand:                    testSudoers,
+			},
+			joined:   true,
+			problems: []string{"no sudo: developers"},
+		},
+		{
+			name: "not joined",
+			runner: fakeRunner{
+				"realm list --name-only 2>/dev/null": "",
+				"sudo -n cat /etc/sssd/sssd.conf":    "[sssd]\ndomains = other.example.com\n",
+				sudoersCommand:                       testSudoers + "%developers ALL=(ALL) ALL\n",
+			},
+			problems: []string{"not joined to corp.example.com"},
+		},
+		{
+			name: "login denied",
+			runner: fakeRunner{
+				"sudo -n cat /etc/sssd/sssd.conf": "[sssd]\ndomains = corp.example.com\n[domain/corp.example.com]\naccess_provider = simple\nsimple_allow_groups = linux-admins\n",
+				sudoersCommand:                    testSudoers + "%developers ALL=(ALL) ALL\n",
+			},
+			joined:   true,
+			problems: []string{"login denied: developers"},
+		},
+		{
+			name:     "nothing readable",
+			runner:   fakeRunner{},
+			facts:    map[string]string{},
+			problems: []string{"sssd.conf unreadable", "sudoers unreadable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facts, err := LdapFacts{}.Gather(context.Background(), tt.runner, instance, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.facts {
+				if facts[k] != v {
+					t.Errorf("fact %s = %q, want %q", k, facts[k], v)
+				}
+			}
+			if tt.facts != nil && len(tt.facts) == 0 && len(facts) != 0 {
+				t.Errorf("facts = %q, want none", facts)
+			}
+
+			stored := map[string]string{"system.os.id": "rhel"}
+			for k, v := range facts {
+				stored["ldap."+k] = v
+			}
+			result := CheckLdap(c, instance, stored, time.Now())
+			if result.Joined != tt.joined {
+				t.Errorf("joined = %t, want %t", result.Joined, tt.joined)
+			}
+			if !slices.Equal(result.Problems, tt.problems) {
+				t.Errorf("problems = %q, want %q", result.Problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestCheckLdapUnreachable(t *testing.T) {
+	c := testSettings(t, "{}")
+	result := CheckLdap(c, Instance{ID: "i-1"}, nil, time.Time{})
+	if result.Reachable || !slices.Equal(result.Problems, []string{"unreachable"}) {
+		t.Errorf("result = %+v", result)
+	}
+}
@@ -0,0 +1,168 @@
+package inventoryengine
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultColumns are shown by the table format when no columns are chosen.
+var DefaultColumns = []string{"cloud_provider", "account", "region", "id", "name", "state", "private_ip"}
+
+// ListFormats are the formats understood by WriteInstances.
+var ListFormats = []string{"table", "json", "jsonl", "yaml", "csv", "template"}
+
+// FindInstances queries the inventory database.
+func (i *Inventory) FindInstances(filter Filter) ([]Instance, error) {
+	return i.db.FindInstances(filter)
+}
+
+// ListOptions controls WriteInstances.  Columns (field names or "tag:Key")
+// apply to the table and csv formats; json, jsonl and yaml always write whole
+// instances.  Template is a text/template run once per instance.
+type ListOptions struct {
+	Format   string
+	Columns  []string
+	Template string
+}
+
+// ParseColumns splits a comma separated column list and checks the names.
+func ParseColumns(value string) ([]string, error) {
+	columns := make([]string, 0)
+	for _, column := range strings.Split(value, ",") {
+		column = strings.TrimSpace(column)
+		if column == "" {
+			continue
+		}
+		name := FieldName(column)
+		if name == "" {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+		columns = append(columns, name)
+	}
+	return columns, nil
+}
+
+// WriteInstances renders instances in one of the ListFormats.
+func WriteInstances(w io.Writer, instances []Instance, opts ListOptions) error {
+	columns := opts.Columns
+	switch opts.Format {
+	case "table", "":
+		if len(columns) == 0 {
+			columns = DefaultColumns
+		}
+		return writeInstanceTable(w, instances, columns)
+	case "csv":
+		if len(columns) == 0 {
+			columns = FieldNames()
+		}
+		return writeInstanceCSV(w, instances, columns)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(instances)
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		for _, instance := range instances {
+			if err := enc.Encode(instance); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(instances); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "template":
+		return writeInstanceTemplate(w, instances, opts.Template)
+	}
+	return fmt.Errorf("unknown format %q (want one of %s)", opts.Format, strings.Join(ListFormats, ", "))
+}
+
+func columnValues(instance Instance, columns []string) []string {
+	values := make([]string, len(columns))
+	for n, column := range columns {
+		values[n], _ = FieldValue(instance, column)
+	}
+	return values
+}
+
+func writeInstanceTable(w io.Writer, instances []Instance, columns []string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := make([]string, len(columns))
+	for n, column := range columns {
+		if tag, ok := strings.CutPrefix(column, "tag:"); ok {
+			header[n] = tag
+			continue
+		}
+		header[n] = strings.ToUpper(strings.ReplaceAll(column, "_", " "))
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, instance := range instances {
+		fmt.Fprintln(tw, strings.Join(columnValues(instance, columns), "\t"))
+	}
+	return tw.Flush()
+}
+
+func writeInstanceCSV(w io.Writer, instances []Instance, columns []string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if err := cw.Write(columnValues(instance, columns)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Functions available to list templates on top of the instance fields:
+// {{field "private_ip"}} and {{tag "Owner"}}.
+func templateFuncs(instance *Instance) template.FuncMap {
+	return template.FuncMap{
+		"field": func(name string) string {
+			value, _ := FieldValue(*instance, name)
+			return value
+		},
+		"tag": func(key string) string {
+			return instance.Tags[key]
+		},
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+}
+
+// writeInstanceTemplate runs the template for every instance, ending each
+// with a newline unless the template already does.
+func writeInstanceTemplate(w io.Writer, instances []Instance, text string) error {
+	if text == "" {
+		return fmt.Errorf("the template format needs a template")
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	var current Instance
+	tmpl, err := template.New("list").Funcs(templateFuncs(&current)).Parse(text)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		current = instance
+		if err := tmpl.Execute(w, instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package inventoryengine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked means another run holds the lock.
+var ErrLocked = errors.New("another inventory run is in progress")
+
+// LockFile is the advisory lock taken in datadir for every roll.
+const LockFile = "inventory.lock"
+
+// Lock is a held advisory lock.
+type Lock struct {
+	file *os.File
+}
+
+// AcquireLock takes the lock file in dir without waiting.  The file holds
+// the PID of the owner, for humans; the lock itself goes away with the
+// process, so a crashed run never leaves it stuck.
+func AcquireLock(dir string) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, LockFile)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		data, _ := os.ReadFile(name)
+		f.Close()
+		if pid := strings.TrimSpace(string(data)); pid != "" {
+			return nil, errors.Join(ErrLocked, errors.New("held by pid "+pid))
+		}
+		return nil, ErrLocked
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return &Lock{file: f}, nil
+}
+
+func (l *Lock) Release() error {
+	l.file.Truncate(0)
+	unlockFile(l.file)
+	return l.file.Close()
+}
@@ -0,0 +1,31 @@
+//go:build !unix
+
+package inventoryengine
+
+import (
+	"os"
+	"sync"
+)
+
+// Without flock the lock only keeps out other runs in this process.
+var (
+	locked   = make(map[string]bool)
+	lockedMu sync.Mutex
+)
+
+func lockFile(f *os.File) error {
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	if locked[f.Name()] {
+		return ErrLocked
+	}
+	locked[f.Name()] = true
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	delete(locked, f.Name())
+	return nil
+}
@@ -0,0 +1,132 @@
+package inventoryengine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// Logging flags.  Empty values fall back to the log section of the settings
+// file.
+var (
+	LogLevel  string
+	LogFormat string
+	LogFile   string
+)
+
+// logFile is the file the default logger writes to, if any.
+var logFile *os.File
+
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a context whose log records carry key/value pairs
+// such as the run, account, region or instance, on top of those ctx already
+// carries.
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	r := slog.Record{}
+	r.Add(args...)
+	added := make([]slog.Attr, 0, len(attrs)+r.NumAttrs())
+	added = append(added, attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		added = append(added, a)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, added)
+}
+
+// contextHandler adds the attributes of WithLogAttrs to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// SetupLogging points the default slog logger, which the standard log
+// package also writes through, at stderr or the log file.  A relative log
+// file lives in datadir.  It is called again when the settings are reloaded.
+func (i *Inventory) SetupLogging() error {
+	c := i.Config().Log
+	var level slog.Level
+	name := strings.ToLower(firstSet(LogLevel, c.Level, "info"))
+	if name == "warning" {
+		name = "warn"
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("log level: %w", err)
+	}
+
+	var w io.Writer = os.Stderr
+	var f *os.File
+	if file := firstSet(LogFile, c.File); file != "" {
+		file = config.ParseTilde(file)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(i.Datadir(), file)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		var err error
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := firstSet(LogFormat, c.Format, "text"); format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		if f != nil {
+			f.Close()
+		}
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = f
+	return nil
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
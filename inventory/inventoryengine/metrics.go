@@ -0,0 +1,185 @@
+package inventoryengine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+	"github.com/ascheel/goinventory/inventory/sshtest"
+)
+
+// resetProbes forgets the probes of the previous run.
+func (i *Inventory) resetProbes() {
+	i.probeMu.Lock()
+	defer i.probeMu.Unlock()
+	i.probes = make(map[string]int)
+	i.reachable = make(map[string]bool)
+}
+
+// recordProbe counts an SSH connection attempt by its outcome.
+func (i *Inventory) recordProbe(err error) {
+	i.probeMu.Lock()
+	defer i.probeMu.Unlock()
+	if i.probes == nil {
+		i.probes = make(map[string]int)
+	}
+	i.probes[sshtest.ErrorClass(err)]++
+}
+
+// setReachable records whether fact gathering could log in to an instance.
+func (i *Inventory) setReachable(id string, reachable bool) {
+	i.probeMu.Lock()
+	defer i.probeMu.Unlock()
+	if i.reachable == nil {
+		i.reachable = make(map[string]bool)
+	}
+	i.reachable[id] = reachable
+}
+
+// isReachable reports whether an instance could be logged in to this run,
+// and whether it was tried at all.
+func (i *Inventory) isReachable(id string) (bool, bool) {
+	i.probeMu.Lock()
+	defer i.probeMu.Unlock()
+	reachable, probed := i.reachable[id]
+	return reachable, probed
+}
+
+// metric is one Prometheus metric family being built.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples map[string]float64
+}
+
+func newMetric(name string, kind string, help string) *metric {
+	return &metric{name: "goinventory_" + name, help: help, kind: kind, samples: make(map[string]float64)}
+}
+
+// labels renders label pairs, escaped as the text format wants.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for n := 0; n+1 < len(pairs); n += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[n+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[n], value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metric) add(value float64, pairs ...string) {
+	m.samples[labels(pairs...)] += value
+}
+
+func (m *metric) set(value float64, pairs ...string) {
+	m.samples[labels(pairs...)] = value
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	for _, l := range sortedKeys(m.samples) {
+		fmt.Fprintf(w, "%s%s %g\n", m.name, l, m.samples[l])
+	}
+}
+
+// untagged reports whether an instance lacks a required tag, or, with none
+// required, has no tags of its own at all.
+func untagged(instance Instance, required []string) bool {
+	if len(required) == 0 {
+		for k := range instance.Tags {
+			if !strings.HasPrefix(k, CMDBTagPrefix) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, tag := range required {
+		if instance.Tags[tag] == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteMetrics writes the inventory in the Prometheus text format: instance
+// counts from the database, the latest scan of every scope, and the SSH
+// probes of the last run of this process.
+func (i *Inventory) WriteMetrics(w io.Writer) error {
+	instances, err := i.db.ListAllInstances()
+	if err != nil {
+		return err
+	}
+	scans, err := i.db.ListScans()
+	if err != nil {
+		return err
+	}
+
+	count := newMetric("instances", "gauge", "Instances in the inventory.")
+	untaggedCount := newMetric("untagged_instances", "gauge", "Instances that aren't terminated and lack required tags.")
+	required := i.Config().Inventory.Ec2_required_tags
+	for _, instance := range instances {
+		count.add(1, "provider", instance.CloudProvider, "account", instance.Account, "region", instance.Region,
+			"state", instance.State, "os", instance.OS)
+		if instance.State != "terminated" && untagged(instance, required) {
+			untaggedCount.add(1, "provider", instance.CloudProvider, "account", instance.Account, "region", instance.Region)
+		}
+	}
+
+	duration := newMetric("scan_duration_seconds", "gauge", "Duration of the latest scan of a scope.")
+	found := newMetric("scan_instances", "gauge", "Instances found by the latest scan of a scope.")
+	scanErr := newMetric("scan_error", "gauge", "1 if the latest scan of a scope failed.")
+	lastScan := newMetric("last_scan_timestamp_seconds", "gauge", "Time of the latest scan of a scope.")
+	lastSuccess := newMetric("last_success_timestamp_seconds", "gauge", "Time a scope was last scanned successfully.")
+	accountSuccess := newMetric("account_last_success_timestamp_seconds", "gauge", "Time every scope of an account was last scanned successfully.")
+	accountOldest := make(map[[2]string]time.Time)
+	for _, s := range scans {
+		pairs := []string{"provider", s.Scope.Provider, "account", s.Scope.Account, "region", s.Scope.Region}
+		duration.set(s.Duration, pairs...)
+		found.set(float64(s.Count), pairs...)
+		lastScan.set(float64(s.LastScan.Unix()), pairs...)
+		failed := 0.0
+		if s.Error != "" {
+			failed = 1
+		}
+		scanErr.set(failed, pairs...)
+		success := 0.0
+		if !s.LastSuccess.IsZero() {
+			success = float64(s.LastSuccess.Unix())
+		}
+		lastSuccess.set(success, pairs...)
+
+		// An account is only as fresh as its stalest region.
+		key := [2]string{s.Scope.Provider, s.Scope.Account}
+		if oldest, ok := accountOldest[key]; !ok || s.LastSuccess.Before(oldest) {
+			accountOldest[key] = s.LastSuccess
+		}
+	}
+	for key, oldest := range accountOldest {
+		success := 0.0
+		if !oldest.IsZero() {
+			success = float64(oldest.Unix())
+		}
+		accountSuccess.set(success, "provider", key[0], "account", key[1])
+	}
+
+	probes := newMetric("ssh_probes", "gauge", "SSH connection attempts in the last run by result.")
+	i.probeMu.Lock()
+	for class, n := range i.probes {
+		probes.set(float64(n), "result", class)
+	}
+	i.probeMu.Unlock()
+
+	for _, m := range []*metric{count, untaggedCount, duration, found, scanErr, lastScan, lastSuccess, accountSuccess, probes} {
+		m.write(w)
+	}
+	return nil
+}
+
+// WriteMetricsFile writes the metrics for node_exporter's textfile
+// collector, replacing the file atomically.
+func (i *Inventory) WriteMetricsFile(file string) error {
+	return WriteFileAtomic(config.ParseTilde(file), 0o644, i.WriteMetrics)
+}
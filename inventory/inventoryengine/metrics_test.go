@@ -0,0 +1,50 @@
+package inventoryengine
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteMetricsProbes(t *testing.T) {
+	i := testInventory(t, testSettings(t, "inventory: {}\n"))
+	i.resetProbes()
+	i.recordProbe(nil)
+	i.recordProbe(nil)
+	var b strings.Builder
+	if err := i.WriteMetrics(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `goinventory_ssh_probes{result="success"} 2`) {
+		t.Errorf("probes missing from metrics:\n%s", b.String())
+	}
+}
+
+// Metrics are served while the daemon rolls; run with -race.
+func TestWriteMetricsDuringRoll(t *testing.T) {
+	i := testInventory(t, testSettings(t, "inventory: {}\n"))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 200; n++ {
+			if n%50 == 0 {
+				i.resetProbes()
+			}
+			i.recordProbe(errors.New("connection refused"))
+			i.setReachable("i-1", n%2 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for n := 0; n < 20; n++ {
+			if err := i.WriteMetrics(io.Discard); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
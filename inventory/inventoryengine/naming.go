@@ -0,0 +1,246 @@
+package inventoryengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// DefaultHostName names exported hosts after the instance unless
+// inventory.host_name is set.
+const DefaultHostName = "{{.Name}}"
+
+// HostNames are the names the Ansible, ssh_config and hosts exports give
+// instances.  A name the template gives more than one instance gets the
+// instance ID appended.  Unnamed instances, and those the template gives
+// an empty name, are named by ID.
+type HostNames struct {
+	names      map[string]string
+	duplicates map[string][]string
+}
+
+// regionShort is the short code of an AWS or Azure region, or the region
+// itself if it has none.
+func regionShort(c *config.Settings, region string) string {
+	if r, ok := c.AWS.Regions[region]; ok && r.Short != "" {
+		return r.Short
+	}
+	if r, ok := c.Azure.Regions[region]; ok && r.Short != "" {
+		return r.Short
+	}
+	return region
+}
+
+// hostLabel makes a string usable as a host name: anything but letters,
+// digits, '_' and '-' becomes '-', and empty labels, as left by an unset
+// field, are dropped.
+func hostLabel(name string) string {
+	labels := make([]string, 0)
+	for _, label := range strings.Split(strings.TrimSpace(name), ".") {
+		label = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+				return r
+			}
+			return '-'
+		}, label)
+		if label = strings.Trim(label, "-"); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// ParseHostName parses a host name template.  Besides the instance fields
+// it has short, the short code of a region, lower and upper.
+func ParseHostName(c *config.Settings, text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultHostName
+	}
+	funcs := template.FuncMap{
+		"short": func(region string) string { return regionShort(c, region) },
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+	t, err := template.New("host_name").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("bad inventory.host_name: %w", err)
+	}
+	return t, nil
+}
+
+// NewHostNames names instances with inventory.host_name.  Collisions are
+// looked for among the instances given, so the same filter gives the same
+// names.
+func NewHostNames(c *config.Settings, instances []Instance) (*HostNames, error) {
+	t, err := ParseHostName(c, c.Inventory.HostName)
+	if err != nil {
+		return nil, err
+	}
+	h := &HostNames{
+		names:      make(map[string]string),
+		duplicates: make(map[string][]string),
+	}
+	byName := make(map[string][]string)
+	for _, instance := range instances {
+		if strings.TrimSpace(instance.Name) == "" {
+			continue
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, instance); err != nil {
+			return nil, fmt.Errorf("inventory.host_name for %s: %w", instance.ID, err)
+		}
+		name := hostLabel(b.String())
+		if name == "" || name == instance.ID {
+			continue
+		}
+		byName[name] = append(byName[name], instance.ID)
+	}
+	for name, ids := range byName {
+		if len(ids) == 1 {
+			h.names[ids[0]] = name
+			continue
+		}
+		sort.Strings(ids)
+		h.duplicates[name] = ids
+		for _, id := range ids {
+			h.names[id] = name + "-" + id
+		}
+		slog.Debug("Host name is not unique, appending the instance ID", "name", name, "instances", ids)
+	}
+	return h, nil
+}
+
+// Name is the host name of an instance.
+func (h *HostNames) Name(instance Instance) string {
+	if name, ok := h.names[instance.ID]; ok {
+		return name
+	}
+	return instance.ID
+}
+
+// Duplicates maps each name the template gave more than one instance to
+// their IDs.
+func (h *HostNames) Duplicates() map[string][]string {
+	return h.duplicates
+}
+
+// Duplicate reports whether an instance shares its templated name.
+func (h *HostNames) Duplicate(instance Instance) bool {
+	for _, ids := range h.duplicates {
+		for _, id := range ids {
+			if id == instance.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// warnDuplicates logs the names that needed an instance ID to be unique.
+func (h *HostNames) warnDuplicates(export string) {
+	for _, name := range sortedKeys(h.duplicates) {
+		slog.Warn("Host name is not unique, appending the instance ID", "export", export, "name", name, "instances", h.duplicates[name])
+	}
+}
+
+// HostNameEntry is one line of the names report.
+type HostNameEntry struct {
+	Provider  string `yaml:"provider" json:"provider"`
+	Account   string `yaml:"account" json:"account"`
+	Region    string `yaml:"region" json:"region"`
+	ID        string `yaml:"id" json:"id"`
+	Name      string `yaml:"name" json:"name"`
+	HostName  string `yaml:"host_name" json:"host_name"`
+	Duplicate bool   `yaml:"duplicate" json:"duplicate"`
+}
+
+// WriteHostNames renders the host name of every instance as "table" or
+// "json", or with duplicates, only the instances whose names collided.
+func WriteHostNames(w io.Writer, instances []Instance, names *HostNames, format string, duplicates bool) error {
+	entries := make([]HostNameEntry, 0, len(instances))
+	for _, instance := range instances {
+		dup := names.Duplicate(instance)
+		if duplicates && !dup {
+			continue
+		}
+		entries = append(entries, HostNameEntry{
+			Provider:  instance.CloudProvider,
+			Account:   instance.Account,
+			Region:    instance.Region,
+			ID:        instance.ID,
+			Name:      instance.Name,
+			HostName:  names.Name(instance),
+			Duplicate: dup,
+		})
+	}
+	sort.SliceStable(entries, func(a, b int) bool { return entries[a].HostName < entries[b].HostName })
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(entries)
+	case "table", "":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tACCOUNT\tREGION\tID\tNAME\tHOST NAME")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Provider, e.Account, e.Region, e.ID, e.Name, e.HostName)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	count := 0
+	for _, ids := range names.Duplicates() {
+		count += len(ids)
+	}
+	fmt.Fprintf(w, "%d duplicate names across %d instances\n", len(names.Duplicates()), count)
+	return nil
+}
+
+// WriteHosts writes an /etc/hosts style file: the address of every
+// instance with its host name and ID.
+func WriteHosts(w io.Writer, instances []Instance, names *HostNames) error {
+	fmt.Fprintf(w, "# Managed by goinventory, %s.  Changes will be overwritten.\n", time.Now().UTC().Format(time.RFC3339))
+	for _, instance := range instances {
+		address, err := instance.GetConnectionAddress()
+		if err != nil {
+			continue
+		}
+		name := names.Name(instance)
+		line := address + "\t" + name
+		if name != instance.ID {
+			line += " " + instance.ID
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportHosts writes the hosts file of the instances matching the filter.
+func (i *Inventory) ExportHosts(w io.Writer, filter Filter) error {
+	instances, err := i.FindInstances(filter)
+	if err != nil {
+		return err
+	}
+	names, err := NewHostNames(i.Config(), instances)
+	if err != nil {
+		return err
+	}
+	names.warnDuplicates("hosts")
+	return WriteHosts(w, instances, names)
+}
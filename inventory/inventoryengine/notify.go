@@ -0,0 +1,297 @@
+package inventoryengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// NotifyEvents are the events notifications can be sent for.  "untagged"
+// and "unreachable" are only sent when an instance gets into that state, not
+// on every run it stays there.
+var NotifyEvents = []string{"new", "terminated", "untagged", "unreachable"}
+
+// NotifyEvent is one thing that happened to an instance in a run.
+type NotifyEvent struct {
+	Event    string `yaml:"event" json:"event"`
+	ID       string `yaml:"id" json:"id"`
+	Name     string `yaml:"name" json:"name"`
+	Provider string `yaml:"provider" json:"provider"`
+	Account  string `yaml:"account" json:"account"`
+	Region   string `yaml:"region" json:"region"`
+	Detail   string `yaml:"detail" json:"detail"`
+}
+
+func newNotifyEvent(event string, instance Instance, detail string) NotifyEvent {
+	return NotifyEvent{
+		Event:    event,
+		ID:       instance.ID,
+		Name:     instance.Name,
+		Provider: instance.CloudProvider,
+		Account:  instance.Account,
+		Region:   instance.Region,
+		Detail:   detail,
+	}
+}
+
+func (e NotifyEvent) String() string {
+	s := fmt.Sprintf("%s: %s", e.Event, e.ID)
+	if e.Name != "" {
+		s += " " + e.Name
+	}
+	s += fmt.Sprintf(" (%s/%s/%s)", e.Provider, e.Account, e.Region)
+	if e.Detail != "" {
+		s += " " + e.Detail
+	}
+	return s
+}
+
+// missingTags lists the required tags an instance doesn't have.
+func missingTags(instance Instance, required []string) []string {
+	missing := make([]string, 0)
+	for _, tag := range required {
+		if instance.Tags[tag] == "" {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+// changeEvents collects the events of the last roll.  For the lasting ones
+// it also returns which instances entered and left the state, by event.
+func (i *Inventory) changeEvents() ([]NotifyEvent, map[string][2][]string, error) {
+	events := make([]NotifyEvent, 0)
+	transitions := make(map[string][2][]string)
+
+	for _, id := range i.Report.new {
+		events = append(events, newNotifyEvent("new", i.Instances[id], ""))
+	}
+	for _, id := range i.Report.terminated {
+		instance, _, err := i.db.GetInstance(id)
+		if err != nil {
+			return events, transitions, err
+		}
+		instance.ID = id
+		events = append(events, newNotifyEvent("terminated", instance, ""))
+	}
+
+	// Lasting states of the instances scanned this run.  Each check returns
+	// a detail, whether the instance is in the state, and whether that can
+	// be told at all.
+	required := i.Config().Inventory.Ec2_required_tags
+	states := map[string]func(Instance) (string, bool, bool){
+		"untagged": func(instance Instance) (string, bool, bool) {
+			missing := missingTags(instance, required)
+			return "missing tags: " + strings.Join(missing, ", "), len(missing) > 0, len(required) > 0
+		},
+		// Only running instances are expected to answer.
+		"unreachable": func(instance Instance) (string, bool, bool) {
+			reachable, probed := i.isReachable(instance.ID)
+			return "SSH login failed", !reachable, probed && instance.State == "running"
+		},
+	}
+	ids := sortedKeys(i.Instances)
+	for _, event := range sortedKeys(states) {
+		notified, err := i.db.Notified(event)
+		if err != nil {
+			return events, transitions, err
+		}
+		var entered, left []string
+		for _, id := range ids {
+			instance := i.Instances[id]
+			detail, in, known := states[event](instance)
+			switch {
+			case !known || instance.State == "terminated":
+				continue
+			case in && !notified[id]:
+				events = append(events, newNotifyEvent(event, instance, detail))
+				entered = append(entered, id)
+			case !in && notified[id]:
+				left = append(left, id)
+			}
+		}
+		transitions[event] = [2][]string{entered, left}
+	}
+	return events, transitions, nil
+}
+
+// targetWants reports whether a target wants an event.
+func targetWants(target config.NotifyTarget, e NotifyEvent) bool {
+	if len(target.Events) > 0 && !slices.Contains(target.Events, e.Event) {
+		return false
+	}
+	if len(target.Accounts) == 0 {
+		return true
+	}
+	for _, pattern := range target.Accounts {
+		if ok, _ := path.Match(pattern, e.Account); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifySummary counts events, as in "2 new, 1 terminated".
+func NotifySummary(events []NotifyEvent) string {
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[e.Event]++
+	}
+	parts := make([]string, 0)
+	for _, event := range NotifyEvents {
+		if counts[event] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[event], event))
+		}
+	}
+	return "Inventory changes: " + strings.Join(parts, ", ")
+}
+
+// Notify sends the events of the last roll to every configured target that
+// wants some of them.  Every target is tried; the errors are returned
+// together.  An instance only counts as notified of a lasting state once a
+// target has delivered it, so failed ones are sent again next run.
+func (i *Inventory) Notify(runID int64) error {
+	targets := i.Config().Notify
+	if len(targets) == 0 {
+		return nil
+	}
+	events, transitions, err := i.changeEvents()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		return slices.Index(NotifyEvents, events[a].Event) < slices.Index(NotifyEvents, events[b].Event)
+	})
+
+	var errs []error
+	// Event and instance ID of what got through.
+	delivered := make(map[[2]string]bool)
+	for _, target := range targets {
+		wanted := make([]NotifyEvent, 0)
+		for _, e := range events {
+			if targetWants(target, e) {
+				wanted = append(wanted, e)
+			}
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+		slog.Info("Sending notification", "target", target.Name, "events", len(wanted))
+		if err := SendNotification(target, runID, wanted); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", target.Name, err))
+			continue
+		}
+		for _, e := range wanted {
+			delivered[[2]string{e.Event, e.ID}] = true
+		}
+	}
+
+	now := time.Now()
+	for event, t := range transitions {
+		sent := make([]string, 0, len(t[0]))
+		for _, id := range t[0] {
+			if delivered[[2]string{event, id}] {
+				sent = append(sent, id)
+			}
+		}
+		if err := i.db.SetNotified(event, sent, t[1], now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// SendNotification delivers events to one target.
+func SendNotification(target config.NotifyTarget, runID int64, events []NotifyEvent) error {
+	summary := NotifySummary(events)
+	lines := make([]string, len(events))
+	for n, e := range events {
+		lines[n] = e.String()
+	}
+
+	var payload any
+	switch target.Type {
+	case "webhook", "":
+		payload = map[string]any{
+			"source":  "goinventory",
+			"run_id":  runID,
+			"time":    time.Now().UTC(),
+			"summary": summary,
+			"events":  events,
+		}
+	case "slack":
+		payload = map[string]any{
+			"text": summary + "\n```\n" + strings.Join(lines, "\n") + "\n```",
+		}
+	case "teams":
+		payload = map[string]any{
+			"@type":    "MessageCard",
+			"@context": "http://schema.org/extensions",
+			"summary":  summary,
+			"title":    summary,
+			"text":     strings.Join(lines, "\n\n"),
+		}
+	case "email":
+		return sendEmail(target, summary, lines)
+	default:
+		return fmt.Errorf("unknown notification type %q", target.Type)
+	}
+
+	url := target.URL
+	if target.URLEnv != "" {
+		url = os.Getenv(target.URLEnv)
+	}
+	if url == "" {
+		return errors.New("no url")
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func sendEmail(target config.NotifyTarget, summary string, lines []string) error {
+	if target.SMTP == "" || target.From == "" || len(target.To) == 0 {
+		return errors.New("email needs smtp, from and to")
+	}
+	var auth smtp.Auth
+	if target.User != "" {
+		host, _, _ := strings.Cut(target.SMTP, ":")
+		auth = smtp.PlainAuth("", target.User, os.Getenv(target.PasswordEnv), host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", target.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(target.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", summary)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, line := range lines {
+		fmt.Fprintf(&msg, "%s\r\n", line)
+	}
+	return smtp.SendMail(target.SMTP, auth, target.From, target.To, msg.Bytes())
+}
@@ -0,0 +1,300 @@
+package inventoryengine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// fakeHook is a webhook endpoint answering with status and keeping the JSON
+// bodies it was sent.
+type fakeHook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	bodies []map[string]any
+}
+
+func newFakeHook(t *testing.T, status int) *fakeHook {
+	h := &fakeHook{status: status}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		var body map[string]any
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.bodies = append(h.bodies, body)
+		if h.status != http.StatusOK {
+			http.Error(w, "hook is down", h.status)
+		}
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+var testEvents = []NotifyEvent{
+	{Event: "new", ID: "i-1", Name: "web1", Provider: "aws", Account: "prod", Region: "us-east-1"},
+	{Event: "untagged", ID: "i-2", Provider: "aws", Account: "dev", Region: "us-east-1", Detail: "missing tags: Owner"},
+}
+
+func TestTargetWants(t *testing.T) {
+	tests := []struct {
+		target config.NotifyTarget
+		event  NotifyEvent
+		want   bool
+	}{
+		{config.NotifyTarget{}, testEvents[0], true},
+		{config.NotifyTarget{Events: []string{"new"}}, testEvents[0], true},
+		{config.NotifyTarget{Events: []string{"new"}}, testEvents[1], false},
+		{config.NotifyTarget{Accounts: []string{"prod"}}, testEvents[0], true},
+		{config.NotifyTarget{Accounts: []string{"prod"}}, testEvents[1], false},
+		{config.NotifyTarget{Accounts: []string{"pr*", "qa"}}, testEvents[0], true},
+		{config.NotifyTarget{Events: []string{"untagged"}, Accounts: []string{"prod"}}, testEvents[1], false},
+		{config.NotifyTarget{Events: []string{"untagged"}, Accounts: []string{"d?v"}}, testEvents[1], true},
+	}
+	for _, tt := range tests {
+		if got := targetWants(tt.target, tt.event); got != tt.want {
+			t.Errorf("targetWants(%+v, %s) = %v, want %v", tt.target, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestSendNotificationPayloads(t *testing.T) {
+	hook := newFakeHook(t, http.StatusOK)
+	t.Setenv("TEST_HOOK_URL", hook.URL)
+	summary := "Inventory changes: 1 new, 1 untagged"
+
+	if err := SendNotification(config.NotifyTarget{URLEnv: "TEST_HOOK_URL"}, 7, testEvents); err != nil {
+		t.Fatalf("webhook: %v", err)
+	}
+	if err := SendNotification(config.NotifyTarget{Type: "slack", URL: hook.URL}, 7, testEvents); err != nil {
+		t.Fatalf("slack: %v", err)
+	}
+	if err := SendNotification(config.NotifyTarget{Type: "teams", URL: hook.URL}, 7, testEvents); err != nil {
+		t.Fatalf("teams: %v", err)
+	}
+	if len(hook.bodies) != 3 {
+		t.Fatalf("hook got %d bodies, want 3", len(hook.bodies))
+	}
+
+	webhook := hook.bodies[0]
+	if webhook["source"] != "goinventory" || webhook["run_id"] != 7.0 || webhook["summary"] != summary {
+		t.Errorf("webhook payload = %v", webhook)
+	}
+	events, _ := webhook["events"].([]any)
+	if len(events) != 2 || events[1].(map[string]any)["detail"] != "missing tags: Owner" {
+		t.Errorf("webhook events = %v", webhook["events"])
+	}
+
+	slack := hook.bodies[1]["text"].(string)
+	if !strings.HasPrefix(slack, summary+"\n```\n") || !strings.Contains(slack, testEvents[0].String()+"\n"+testEvents[1].String()) {
+		t.Errorf("slack text = %q", slack)
+	}
+
+	teams := hook.bodies[2]
+	if teams["@type"] != "MessageCard" || teams["title"] != summary ||
+		teams["text"] != testEvents[0].String()+"\n\n"+testEvents[1].String() {
+		t.Errorf("teams payload = %v", teams)
+	}
+}
+
+func TestSendNotificationErrors(t *testing.T) {
+	hook := newFakeHook(t, http.StatusInternalServerError)
+	err := SendNotification(config.NotifyTarget{URL: hook.URL}, 1, testEvents)
+	if err == nil || !strings.Contains(err.Error(), "500") || !strings.Contains(err.Error(), "hook is down") {
+		t.Errorf("failing hook: %v", err)
+	}
+	if err := SendNotification(config.NotifyTarget{URLEnv: "TEST_UNSET_HOOK_URL"}, 1, testEvents); err == nil {
+		t.Error("empty url succeeded")
+	}
+	if err := SendNotification(config.NotifyTarget{Type: "pager"}, 1, testEvents); err == nil {
+		t.Error("unknown type succeeded")
+	}
+}
+
+// fakeSMTP is just enough of an SMTP server for net/smtp: no extensions, so
+// no STARTTLS or AUTH, and every message is accepted.
+type fakeSMTP struct {
+	net.Listener
+	mu   sync.Mutex
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		s.mu.Lock()
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case "MAIL":
+			s.from = arg
+			reply("250 OK")
+		case "RCPT":
+			s.to = append(s.to, arg)
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			s.mu.Unlock()
+			return
+		default:
+			reply("502 unknown command")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	server := newFakeSMTP(t)
+	target := config.NotifyTarget{
+		Type: "email",
+		SMTP: server.Addr().String(),
+		From: "inventory@example.com",
+		To:   []string{"ops@example.com", "sec@example.com"},
+	}
+	if err := SendNotification(target, 1, testEvents); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.from != "FROM:<inventory@example.com>" {
+		t.Errorf("MAIL %s", server.from)
+	}
+	if !slices.Equal(server.to, []string{"TO:<ops@example.com>", "TO:<sec@example.com>"}) {
+		t.Errorf("RCPT %v", server.to)
+	}
+	for _, want := range []string{
+		"To: ops@example.com, sec@example.com\r\n",
+		"Subject: Inventory changes: 1 new, 1 untagged\r\n",
+		"\r\n\r\n" + testEvents[0].String() + "\r\n" + testEvents[1].String() + "\r\n",
+	} {
+		if !strings.Contains(server.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, server.data)
+		}
+	}
+
+	if err := SendNotification(config.NotifyTarget{Type: "email", SMTP: server.Addr().String()}, 1, testEvents); err == nil {
+		t.Error("email without from and to succeeded")
+	}
+}
+
+func TestNotifyRecordsDelivered(t *testing.T) {
+	down := newFakeHook(t, http.StatusBadGateway)
+	up := newFakeHook(t, http.StatusOK)
+	i := testInventory(t, testSettings(t, fmt.Sprintf(`
+inventory:
+  ec2_required_tags: [Owner]
+notify:
+  - name: prod
+    url: %s
+    accounts: [prod]
+  - name: dev
+    url: %s
+    accounts: [dev]
+`, down.URL, up.URL)))
+	i.Instances = map[string]Instance{
+		"i-1": {ID: "i-1", Account: "prod", State: "running"},
+		"i-2": {ID: "i-2", Account: "dev", State: "running"},
+	}
+
+	if err := i.Notify(1); err == nil || !strings.Contains(err.Error(), "prod") {
+		t.Fatalf("Notify with a failing target: %v", err)
+	}
+	notified, err := i.db.Notified("untagged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notified["i-1"] || !notified["i-2"] {
+		t.Errorf("notified after first run = %v, want only i-2", notified)
+	}
+
+	// The failed event is sent again; the delivered one isn't.
+	down.mu.Lock()
+	down.status = http.StatusOK
+	down.mu.Unlock()
+	if err := i.Notify(2); err != nil {
+		t.Fatal(err)
+	}
+	if len(down.bodies) != 2 || len(up.bodies) != 1 {
+		t.Errorf("prod target got %d bodies, dev %d; want 2 and 1", len(down.bodies), len(up.bodies))
+	}
+	if notified, _ = i.db.Notified("untagged"); !notified["i-1"] || !notified["i-2"] {
+		t.Errorf("notified after second run = %v, want i-1 and i-2", notified)
+	}
+}
+
+func TestNotifyUnreachableRunningOnly(t *testing.T) {
+	i := testInventory(t, testSettings(t, "{}"))
+	i.Instances = map[string]Instance{
+		"i-1": {ID: "i-1", Account: "prod", State: "running"},
+		"i-2": {ID: "i-2", Account: "prod", State: "stopped"},
+	}
+	i.resetProbes()
+	i.setReachable("i-1", false)
+	i.setReachable("i-2", false)
+
+	events, _, err := i.changeEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != "unreachable" || events[0].ID != "i-1" {
+		t.Errorf("events = %v, want i-1 unreachable only", events)
+	}
+}
@@ -0,0 +1,140 @@
+package inventoryengine
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrNoCredentials is wrapped by providers that can't authenticate at all.
+// With skip_on_no_creds set it only produces a warning.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Scope is the unit a provider scans: an account in a region.  An empty
+// Region means the scan covered every region of the account.
+type Scope struct {
+	Provider string `yaml:"provider" json:"provider"`
+	Account  string `yaml:"account" json:"account"`
+	Region   string `yaml:"region" json:"region"`
+	// Only set where hosts of one account differ in environment, as static
+	// hosts do, and a roll selected some.
+	Env string `yaml:"env,omitempty" json:"env,omitempty"`
+}
+
+func (s Scope) String() string {
+	scope := s.Provider + "/" + s.Account
+	if s.Region != "" {
+		scope += "/" + s.Region
+	}
+	if s.Env != "" {
+		scope += " (" + s.Env + ")"
+	}
+	return scope
+}
+
+// Covers reports whether an instance lives inside the scope.
+func (s Scope) Covers(instance Instance) bool {
+	provider := instance.CloudProvider
+	if provider == "" {
+		provider = "aws"
+	}
+	return s.Provider == provider &&
+		s.Account == instance.Account &&
+		(s.Region == "" || s.Region == instance.Region) &&
+		(s.Env == "" || strings.EqualFold(s.Env, instance.ENV))
+}
+
+// ScopeResult is the outcome of scanning one scope.
+type ScopeResult struct {
+	Scope    Scope         `yaml:"scope" json:"scope"`
+	Count    int           `yaml:"count" json:"count"`
+	Duration time.Duration `yaml:"duration" json:"duration"`
+	Err      error         `yaml:"-" json:"-"`
+}
+
+// Provider is a source of instances: a cloud, or anything else that can list
+// machines.  Discover returns what it found along with a result for every
+// scope it tried, so a failure in one account doesn't hide the others.
+type Provider interface {
+	Name() string
+	Discover(ctx context.Context) ([]Instance, []ScopeResult)
+}
+
+// KeyPairSource is implemented by providers that know the key pairs their
+// instances were launched with.
+type KeyPairSource interface {
+	KeyPairs() map[string]KeyPair
+}
+
+// scanScope times fn and wraps its outcome in a ScopeResult.  Records
+// logged with the context fn gets carry the scope.
+func scanScope(ctx context.Context, scope Scope, fn func(context.Context) ([]Instance, error)) ([]Instance, ScopeResult) {
+	ctx = WithLogAttrs(ctx, "provider", scope.Provider, "account", scope.Account)
+	if scope.Region != "" {
+		ctx = WithLogAttrs(ctx, "region", scope.Region)
+	}
+	if scope.Env != "" {
+		ctx = WithLogAttrs(ctx, "env", scope.Env)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, ScopeResult{Scope: scope, Err: context.Cause(ctx)}
+	}
+	start := time.Now()
+	instances, err := fn(ctx)
+	result := ScopeResult{
+		Scope:    scope,
+		Count:    len(instances),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Scan failed", "err", err)
+	}
+	return instances, result
+}
+
+// Selection narrows a roll to some accounts, regions and environments.
+// Accounts match by name or number, regions by name or short code.  Empty
+// lists select everything.  Clouds select accounts by their env; static
+// hosts, which each have their own, are selected one by one.
+type Selection struct {
+	Accounts   []string
+	Regions    []string
+	Envs       []string
+	AllRegions bool
+}
+
+func selects(wanted []string, names ...string) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, w := range wanted {
+		for _, name := range names {
+			if name != "" && strings.EqualFold(w, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Account reports whether an account is selected by any of its names.
+func (s Selection) Account(names ...string) bool {
+	return selects(s.Accounts, names...)
+}
+
+// Region reports whether a region is selected by its name or short code.
+func (s Selection) Region(names ...string) bool {
+	return selects(s.Regions, names...)
+}
+
+func (s Selection) Env(env string) bool {
+	return selects(s.Envs, env)
+}
+
+// Narrowed reports whether regions or environments are selected.
+func (s Selection) Narrowed() bool {
+	return len(s.Regions) > 0 || len(s.Envs) > 0
+}
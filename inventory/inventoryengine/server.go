@@ -0,0 +1,274 @@
+package inventoryengine
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccountSummary counts the instances of one account.
+type AccountSummary struct {
+	Provider string         `yaml:"provider" json:"provider"`
+	Account  string         `yaml:"account" json:"account"`
+	ENV      string         `yaml:"env" json:"env"`
+	Total    int            `yaml:"total" json:"total"`
+	States   map[string]int `yaml:"states" json:"states"`
+	Regions  []string       `yaml:"regions" json:"regions"`
+	LastSeen time.Time      `yaml:"last_seen" json:"last_seen"`
+}
+
+// Accounts summarises the database per provider and account.
+func (i *Inventory) Accounts() ([]AccountSummary, error) {
+	instances, err := i.db.ListAllInstances()
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[Scope]*AccountSummary)
+	regions := make(map[Scope]map[string]bool)
+	for _, instance := range instances {
+		key := Scope{Provider: instance.CloudProvider, Account: instance.Account}
+		a, ok := byKey[key]
+		if !ok {
+			a = &AccountSummary{Provider: key.Provider, Account: key.Account, ENV: instance.ENV, States: make(map[string]int)}
+			byKey[key] = a
+			regions[key] = make(map[string]bool)
+		}
+		a.Total++
+		a.States[instance.State]++
+		if instance.LastSeen.After(a.LastSeen) {
+			a.LastSeen = instance.LastSeen
+		}
+		if instance.Region != "" && !regions[key][instance.Region] {
+			regions[key][instance.Region] = true
+			a.Regions = append(a.Regions, instance.Region)
+		}
+	}
+
+	summaries := make([]AccountSummary, 0, len(byKey))
+	for _, a := range byKey {
+		sort.Strings(a.Regions)
+		summaries = append(summaries, *a)
+	}
+	sort.Slice(summaries, func(x, y int) bool {
+		if summaries[x].Provider != summaries[y].Provider {
+			return summaries[x].Provider < summaries[y].Provider
+		}
+		return summaries[x].Account < summaries[y].Account
+	})
+	return summaries, nil
+}
+
+// Server is the read-only HTTP API over the inventory:
+//
+//	GET /instances?q=<filter>     instances matching a filter expression
+//	GET /instances/{id}           one instance
+//	GET /instances/{id}/history   what happened to it
+//	GET /accounts                 counts per account
+//	GET /runs?limit=N             latest refreshes
+//	GET /ansible/list             dynamic Ansible inventory
+//	GET /metrics                  Prometheus metrics
+//
+// JSON responses carry an ETag and honour If-None-Match.
+type Server struct {
+	inv     *Inventory
+	mux     *http.ServeMux
+	rolling sync.Mutex
+}
+
+func NewServer(inv *Inventory) *Server {
+	s := &Server{inv: inv, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/instances", s.instances)
+	s.mux.HandleFunc("/instances/", s.instance)
+	s.mux.HandleFunc("/accounts", s.accounts)
+	s.mux.HandleFunc("/runs", s.runs)
+	s.mux.HandleFunc("/ansible/list", s.ansibleList)
+	s.mux.HandleFunc("/metrics", s.metrics)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, http.StatusMethodNotAllowed, "read-only API")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func httpError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: msg})
+}
+
+// writeJSON sends value with an ETag made from the body, or 304 if the
+// client already has it.
+func writeJSON(w http.ResponseWriter, r *http.Request, value any) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(value); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+func (s *Server) instances(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(r.URL.Query()["q"]...)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	instances, err := s.inv.FindInstances(filter)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, instances)
+}
+
+func (s *Server) instance(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+	if id == "" || (rest != "" && rest != "history") {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	instance, found, err := s.inv.db.GetInstance(id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		httpError(w, http.StatusNotFound, "no instance "+id)
+		return
+	}
+	if rest == "" {
+		writeJSON(w, r, instance)
+		return
+	}
+	history, err := s.inv.db.InstanceHistory(id)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, history)
+}
+
+func (s *Server) accounts(w http.ResponseWriter, r *http.Request) {
+	accounts, err := s.inv.Accounts()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, accounts)
+}
+
+func (s *Server) runs(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			httpError(w, http.StatusBadRequest, "bad limit "+value)
+			return
+		}
+		limit = n
+	}
+	runs, err := s.inv.db.ListRuns(limit)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, runs)
+}
+
+func (s *Server) ansibleList(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(append([]string{"state!=terminated"}, r.URL.Query()["q"]...)...)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	instances, err := s.inv.FindInstances(filter)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names, err := NewHostNames(s.inv.Config(), instances)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var body bytes.Buffer
+	if err := BuildAnsibleInventory(s.inv.Config(), instances, names).WriteJSON(&body); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, r, json.RawMessage(body.Bytes()))
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+	if err := s.inv.WriteMetrics(&body); err != nil {
+		httpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(body.Bytes())
+}
+
+// Refresh rolls the inventory unless a roll is already running.
+func (s *Server) Refresh() {
+	if !s.rolling.TryLock() {
+		slog.Warn("Previous refresh still running, skipping this one.")
+		return
+	}
+	defer s.rolling.Unlock()
+	slog.Info("Refreshing inventory.")
+	if err := s.inv.Roll(context.Background()); err != nil {
+		slog.Error("Refresh failed", "err", err)
+	}
+}
+
+// Serve listens on addr.  With a refresh interval the inventory is also
+// rolled in the background, starting straight away.
+func (s *Server) Serve(addr string, refresh time.Duration) error {
+	if refresh > 0 {
+		go func() {
+			s.Refresh()
+			for range time.Tick(refresh) {
+				s.Refresh()
+			}
+		}()
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("Serving the inventory API", "addr", addr)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,198 @@
+package inventoryengine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// DefaultSSHConfig is the managed include file written by ExportSSHConfig.
+const DefaultSSHConfig = "~/.ssh/inventory.conf"
+
+// SSHHost is one Host block of an OpenSSH client config.
+type SSHHost struct {
+	Aliases      []string
+	Comment      string
+	HostName     string
+	User         string
+	Port         string
+	IdentityFile string
+	ProxyJump    string
+}
+
+// sshAlias makes a name usable as a Host pattern.
+func sshAlias(name string) string {
+	name = strings.TrimSpace(name)
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '*', '?', '!', ',', '#', '"':
+			return '-'
+		}
+		return r
+	}, name)
+}
+
+// SSHHosts builds Host blocks for instances with an address, plus one for
+// every proxy they jump through.  Instances are reachable by their host
+// name and by ID.
+func SSHHosts(c *config.Settings, instances []Instance, names *HostNames) []SSHHost {
+	hosts := make([]SSHHost, 0, len(instances))
+	proxies := make(map[string]SSHHost)
+	for _, instance := range instances {
+		if instance.Skip {
+			continue
+		}
+		jump, proxy := jumpHost(c, instance)
+		address := instance.PrivateIP
+		if jump == "" || address == "" {
+			var err error
+			address, err = instance.GetConnectionAddress()
+			if err != nil {
+				continue
+			}
+		}
+
+		// Static IDs are made from free-form names.
+		id := sshAlias(instance.ID)
+		aliases := make([]string, 0, 2)
+		if name := names.Name(instance); name != instance.ID && name != id {
+			aliases = append(aliases, name)
+		}
+		aliases = append(aliases, id)
+
+		port := instance.SSHPort
+		if port == "22" {
+			port = ""
+		}
+		hosts = append(hosts, SSHHost{
+			Aliases:      aliases,
+			Comment:      fmt.Sprintf("%s/%s/%s %s", instance.CloudProvider, instance.Account, instance.Region, instance.State),
+			HostName:     address,
+			User:         instance.User,
+			Port:         port,
+			IdentityFile: instance.SSHKey,
+			ProxyJump:    jump,
+		})
+		if proxy != nil {
+			proxies[proxy.Aliases[0]] = *proxy
+		}
+	}
+
+	proxyNames := make([]string, 0, len(proxies))
+	for name := range proxies {
+		proxyNames = append(proxyNames, name)
+	}
+	sort.Strings(proxyNames)
+	for _, name := range proxyNames {
+		hosts = append(hosts, proxies[name])
+	}
+	return hosts
+}
+
+// jumpHost finds the jump host for an instance from its account's
+// jump_hosts, trying the region, its short code and then "default".  A
+// value naming a proxies entry also returns a Host block for that proxy.
+func jumpHost(c *config.Settings, instance Instance) (string, *SSHHost) {
+	account, ok := c.AWS.Accounts[instance.Account]
+	if !ok || len(account.JumpHosts) == 0 {
+		return "", nil
+	}
+	keys := []string{instance.Region}
+	if region, ok := c.AWS.Regions[instance.Region]; ok && region.Short != "" {
+		keys = append(keys, region.Short)
+	}
+	keys = append(keys, "default")
+
+	for _, key := range keys {
+		value, ok := account.JumpHosts[key]
+		if !ok || value == "" {
+			continue
+		}
+		proxy, ok := c.Proxies[value]
+		if !ok {
+			return value, nil
+		}
+		host := &SSHHost{
+			Aliases:  []string{sshAlias(value)},
+			Comment:  proxy.Description,
+			HostName: proxy.Host,
+			User:     proxy.User,
+			Port:     proxy.Port,
+		}
+		if proxy.Key != "" {
+			host.IdentityFile = config.ParseTilde(proxy.Key)
+		}
+		if host.HostName == "" {
+			host.HostName = value
+		}
+		return host.Aliases[0], host
+	}
+	return "", nil
+}
+
+// WriteSSHConfig renders Host blocks.
+func WriteSSHConfig(w io.Writer, hosts []SSHHost) error {
+	fmt.Fprintf(w, "# Managed by goinventory, %s.  Changes will be overwritten.\n", time.Now().UTC().Format(time.RFC3339))
+	for _, h := range hosts {
+		fmt.Fprintln(w)
+		if h.Comment != "" {
+			fmt.Fprintf(w, "# %s\n", h.Comment)
+		}
+		fmt.Fprintf(w, "Host %s\n", strings.Join(h.Aliases, " "))
+		fmt.Fprintf(w, "    HostName %s\n", h.HostName)
+		if h.User != "" {
+			fmt.Fprintf(w, "    User %s\n", h.User)
+		}
+		if h.Port != "" {
+			fmt.Fprintf(w, "    Port %s\n", h.Port)
+		}
+		if h.IdentityFile != "" {
+			fmt.Fprintf(w, "    IdentityFile %s\n", sshQuote(h.IdentityFile))
+			fmt.Fprintln(w, "    IdentitiesOnly yes")
+		}
+		if h.ProxyJump != "" {
+			fmt.Fprintf(w, "    ProxyJump %s\n", h.ProxyJump)
+		}
+	}
+	return nil
+}
+
+func sshQuote(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// ExportSSHConfig writes Host blocks for the instances matching the filter
+// to the managed include file, replacing it atomically.  It returns the file
+// name and the number of Host blocks.
+func (i *Inventory) ExportSSHConfig(filter Filter, file string) (string, int, error) {
+	c := i.Config()
+	if file == "" {
+		file = c.Inventory.SSHConfig
+	}
+	if file == "" {
+		file = DefaultSSHConfig
+	}
+	file = config.ParseTilde(file)
+
+	instances, err := i.FindInstances(filter)
+	if err != nil {
+		return file, 0, err
+	}
+	names, err := NewHostNames(c, instances)
+	if err != nil {
+		return file, 0, err
+	}
+	names.warnDuplicates("ssh_config")
+	hosts := SSHHosts(c, instances, names)
+	err = WriteFileAtomic(file, 0o600, func(w io.Writer) error {
+		return WriteSSHConfig(w, hosts)
+	})
+	return file, len(hosts), err
+}
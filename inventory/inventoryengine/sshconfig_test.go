@@ -0,0 +1,28 @@
+package inventoryengine
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSSHHostsAliases(t *testing.T) {
+	c := testSettings(t, "{}")
+	instances := []Instance{
+		{ID: "i-0abc", Name: "web1", PrivateIP: "10.0.0.1", CloudProvider: "aws"},
+		{ID: "static-db 1*", Name: "db 1*", PrivateIP: "192.0.2.1", CloudProvider: "static"},
+	}
+	names, err := NewHostNames(c, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := SSHHosts(c, instances, names)
+	if len(hosts) != 2 {
+		t.Fatalf("hosts = %+v", hosts)
+	}
+	if !slices.Equal(hosts[0].Aliases, []string{"web1", "i-0abc"}) {
+		t.Errorf("aws aliases = %q", hosts[0].Aliases)
+	}
+	if !slices.Equal(hosts[1].Aliases, []string{"db-1", "static-db-1-"}) {
+		t.Errorf("static aliases = %q", hosts[1].Aliases)
+	}
+}
@@ -0,0 +1,42 @@
+package inventoryengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// StaleReport lists instances not seen for the given number of days.  These
+// usually belong to an account or region that has dropped out of the scan,
+// since anything actually gone from a scanned scope is marked terminated.
+func (i *Inventory) StaleReport(days int) ([]Instance, error) {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	return i.db.StaleInstances(cutoff)
+}
+
+// WriteStaleReport renders stale instances as "table" or "json".
+func WriteStaleReport(w io.Writer, instances []Instance, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		return enc.Encode(instances)
+	case "table", "":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROVIDER\tACCOUNT\tREGION\tID\tNAME\tLAST SEEN\tDAYS")
+	for _, i := range instances {
+		lastSeen, days := "never", "-"
+		if !i.LastSeen.IsZero() {
+			lastSeen = i.LastSeen.Local().Format(time.DateTime)
+			days = fmt.Sprint(int(time.Since(i.LastSeen).Hours() / 24))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.CloudProvider, i.Account, i.Region, i.ID, i.Name, lastSeen, days)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,367 @@
+package inventoryengine
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	invconfig "github.com/ascheel/goinventory/inventory/config"
+	"gopkg.in/yaml.v3"
+)
+
+// StaticHost is one entry of a static host file.
+type StaticHost struct {
+	ID      string            `yaml:"id" json:"id"`
+	Name    string            `yaml:"name" json:"name"`
+	Address string            `yaml:"address" json:"address"`
+	User    string            `yaml:"user" json:"user"`
+	Key     string            `yaml:"key" json:"key"`
+	Port    string            `yaml:"port" json:"port"`
+	Region  string            `yaml:"region" json:"region"`
+	ENV     string            `yaml:"env" json:"env"`
+	OS      string            `yaml:"os" json:"os"`
+	Notes   string            `yaml:"notes" json:"notes"`
+	Tags    map[string]string `yaml:"tags" json:"tags"`
+}
+
+// Static reads on-prem and colo hosts from YAML or CSV files.  Every file is
+// its own scope, with the file name (less extension) as the account, so no
+// two files may share a name.
+type Static struct {
+	// Selects files by account, and hosts within them by region and env.
+	Selection Selection
+	config    *invconfig.Settings
+}
+
+func NewStatic(c *invconfig.Settings) *Static {
+	instance := &Static{config: c}
+	return instance
+}
+
+func (s *Static) Name() string {
+	return "static"
+}
+
+func (s *Static) Discover(ctx context.Context) ([]Instance, []ScopeResult) {
+	slog.DebugContext(ctx, "Getting static hosts.")
+	instances := make([]Instance, 0)
+	results := make([]ScopeResult, 0)
+
+	files, failed := s.sourceFiles()
+	// A source that can't be read is a failed scope, so its hosts are
+	// neither lost nor taken for terminated.
+	for _, source := range sortedKeys(failed) {
+		scope := Scope{Provider: s.Name(), Account: staticAccount(source)}
+		if !s.Selection.Account(scope.Account) {
+			continue
+		}
+		_, result := scanScope(ctx, scope, func(ctx context.Context) ([]Instance, error) {
+			return nil, failed[source]
+		})
+		results = append(results, result)
+	}
+	for _, file := range files {
+		scope := Scope{Provider: s.Name(), Account: staticAccount(file)}
+		if !s.Selection.Account(scope.Account) {
+			continue
+		}
+		if !s.Selection.Narrowed() {
+			found, result := scanScope(ctx, scope, func(ctx context.Context) ([]Instance, error) {
+				return ReadStaticFile(file)
+			})
+			instances = append(instances, found...)
+			results = append(results, result)
+			continue
+		}
+		hosts, err := ReadStaticFile(file)
+		if err != nil {
+			_, result := scanScope(ctx, scope, func(ctx context.Context) ([]Instance, error) {
+				return nil, err
+			})
+			results = append(results, result)
+			continue
+		}
+		for _, scope := range s.narrowedScopes(scope, hosts) {
+			found, result := scanScope(ctx, scope, func(ctx context.Context) ([]Instance, error) {
+				inScope := make([]Instance, 0)
+				for _, host := range hosts {
+					if scope.Covers(host) {
+						inScope = append(inScope, host)
+					}
+				}
+				return inScope, nil
+			})
+			instances = append(instances, found...)
+			results = append(results, result)
+		}
+	}
+	return instances, results
+}
+
+// narrowedScopes splits a file's scope by the selected regions and
+// environments its hosts are in, so that the hosts left out aren't taken
+// for terminated.
+func (s *Static) narrowedScopes(file Scope, hosts []Instance) []Scope {
+	regions, envs := []string{""}, []string{""}
+	if len(s.Selection.Regions) > 0 {
+		regions = regions[:0]
+		for _, host := range hosts {
+			if s.Selection.Region(host.Region, regionShort(s.config, host.Region)) && !slices.Contains(regions, host.Region) {
+				regions = append(regions, host.Region)
+			}
+		}
+	}
+	if len(s.Selection.Envs) > 0 {
+		envs = envs[:0]
+		for _, host := range hosts {
+			env := strings.ToLower(host.ENV)
+			if s.Selection.Env(env) && !slices.Contains(envs, env) {
+				envs = append(envs, env)
+			}
+		}
+	}
+	scopes := make([]Scope, 0, len(regions)*len(envs))
+	for _, region := range regions {
+		for _, env := range envs {
+			scopes = append(scopes, Scope{Provider: file.Provider, Account: file.Account, Region: region, Env: env})
+		}
+	}
+	return scopes
+}
+
+// sourceFiles expands the configured sources; directories contribute every
+// .yml, .yaml and .csv file directly inside them.  Sources that can't be
+// read are returned with their errors, and so are sources that would share an
+// account with another: each would cover the other's hosts.
+func (s *Static) sourceFiles() ([]string, map[string]error) {
+	files := make([]string, 0)
+	failed := make(map[string]error)
+	for _, source := range s.config.Static.Sources {
+		source = filepath.Clean(invconfig.ParseTilde(source))
+		info, err := os.Stat(source)
+		if err != nil {
+			failed[source] = err
+			continue
+		}
+		if !info.IsDir() {
+			files = append(files, source)
+			continue
+		}
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			failed[source] = err
+			continue
+		}
+		for _, entry := range entries {
+			switch strings.ToLower(filepath.Ext(entry.Name())) {
+			case ".yml", ".yaml", ".csv":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(source, entry.Name()))
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	files = slices.Compact(files)
+
+	byAccount := make(map[string][]string)
+	for _, source := range append(sortedKeys(failed), files...) {
+		account := staticAccount(source)
+		byAccount[account] = append(byAccount[account], source)
+	}
+	unique := make([]string, 0, len(files))
+	for _, file := range files {
+		if len(byAccount[staticAccount(file)]) == 1 {
+			unique = append(unique, file)
+		}
+	}
+	for account, sources := range byAccount {
+		if len(sources) > 1 {
+			for _, source := range sources {
+				delete(failed, source)
+			}
+			failed[sources[0]] = fmt.Errorf("account %s is named by more than one source: %s", account, strings.Join(sources, ", "))
+		}
+	}
+	return unique, failed
+}
+
+func staticAccount(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// ReadStaticFile parses one host file into instances.
+func ReadStaticFile(file string) ([]Instance, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []StaticHost
+	if strings.EqualFold(filepath.Ext(file), ".csv") {
+		hosts, err = ParseStaticCSV(f)
+	} else {
+		hosts, err = ParseStaticYAML(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	account := staticAccount(file)
+	instances := make([]Instance, 0, len(hosts))
+	seen := make(map[string]bool)
+	for n, host := range hosts {
+		instance, err := host.Instance(account)
+		if err != nil {
+			return nil, fmt.Errorf("%s: host %d: %w", file, n+1, err)
+		}
+		if seen[instance.ID] {
+			return nil, fmt.Errorf("%s: duplicate host %s", file, instance.ID)
+		}
+		seen[instance.ID] = true
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// ParseStaticYAML accepts either a list of hosts or a map with a "hosts" list.
+func ParseStaticYAML(r io.Reader) ([]StaticHost, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Hosts []StaticHost `yaml:"hosts"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err == nil && doc.Hosts != nil {
+		return doc.Hosts, nil
+	}
+	var hosts []StaticHost
+	if err := yaml.Unmarshal(data, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// ParseStaticCSV reads a CSV file with a header row naming the StaticHost
+// fields.  Tags are written as "key=value;key=value".
+func ParseStaticCSV(r io.Reader) ([]StaticHost, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]StaticHost, 0)
+	if len(records) == 0 {
+		return hosts, nil
+	}
+
+	header := records[0]
+	for _, record := range records[1:] {
+		var host StaticHost
+		for n, column := range header {
+			value := strings.TrimSpace(record[n])
+			switch strings.ToLower(strings.TrimSpace(column)) {
+			case "id":
+				host.ID = value
+			case "name":
+				host.Name = value
+			case "address":
+				host.Address = value
+			case "user":
+				host.User = value
+			case "key":
+				host.Key = value
+			case "port":
+				host.Port = value
+			case "region":
+				host.Region = value
+			case "env":
+				host.ENV = value
+			case "os":
+				host.OS = value
+			case "notes":
+				host.Notes = value
+			case "tags":
+				host.Tags = parseTagList(value)
+			default:
+				return nil, fmt.Errorf("unknown column %q", column)
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func parseTagList(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(pair, "=")
+		if k = strings.TrimSpace(k); k != "" {
+			tags[k] = strings.TrimSpace(v)
+		}
+	}
+	return tags
+}
+
+// Instance maps a host onto the shared model.  Hosts without an id are keyed
+// by name, which therefore has to be unique within the file.
+func (h StaticHost) Instance(account string) (Instance, error) {
+	if h.Name == "" && h.Address == "" {
+		return Instance{}, fmt.Errorf("name or address is required")
+	}
+	if h.Port != "" {
+		if _, err := strconv.Atoi(h.Port); err != nil {
+			return Instance{}, fmt.Errorf("bad port %q", h.Port)
+		}
+	}
+	name := h.Name
+	if name == "" {
+		name = h.Address
+	}
+	address := h.Address
+	if address == "" {
+		address = h.Name
+	}
+	id := h.ID
+	if id == "" {
+		id = "static-" + name
+	}
+	key := h.Key
+	if key != "" {
+		key = invconfig.ParseTilde(key)
+	}
+	tags := h.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+
+	i := Instance{
+		Account:       account,
+		CloudProvider: "static",
+		ENV:           h.ENV,
+		ID:            id,
+		Name:          name,
+		Notes:         h.Notes,
+		OS:            h.OS,
+		PrivateIP:     address,
+		Region:        h.Region,
+		SSHKey:        key,
+		SSHPort:       h.Port,
+		State:         "running",
+		Tags:          tags,
+		User:          h.User,
+	}
+	return i, nil
+}
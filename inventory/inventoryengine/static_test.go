@@ -0,0 +1,123 @@
+package inventoryengine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticDiscoverBadSource(t *testing.T) {
+	dir := t.TempDir()
+	colo := filepath.Join(dir, "colo.yml")
+	if err := os.WriteFile(colo, []byte("hosts:\n  - name: db1\n    address: 192.0.2.10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lab := filepath.Join(dir, "lab.csv")
+	if err := os.WriteFile(lab, []byte("name,address\nbench1,192.0.2.20\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "gone.yml")
+
+	c := testSettings(t, "{}")
+	// The bad source comes first; the ones after it still count.
+	c.Static.Sources = []string{missing, colo, lab}
+	instances, results := NewStatic(c).Discover(context.Background())
+
+	if len(instances) != 2 {
+		t.Errorf("instances = %+v, want db1 and bench1", instances)
+	}
+	if len(results) != 3 {
+		t.Fatalf("results = %+v, want one per source", results)
+	}
+	byAccount := make(map[string]ScopeResult)
+	for _, r := range results {
+		byAccount[r.Scope.Account] = r
+	}
+	if r := byAccount["gone"]; r.Err == nil || !os.IsNotExist(r.Err) {
+		t.Errorf("gone = %+v, want a failed scope", r)
+	}
+	for _, account := range []string{"colo", "lab"} {
+		if r := byAccount[account]; r.Err != nil || r.Count != 1 {
+			t.Errorf("%s = %+v", account, r)
+		}
+	}
+}
+
+func TestStaticDiscoverSelection(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dc.csv")
+	hosts := "name,address,region,env\n" +
+		"web1,192.0.2.1,dc1,prod\n" +
+		"web2,192.0.2.2,dc1,test\n" +
+		"web3,192.0.2.3,dc2,Prod\n" +
+		"web4,192.0.2.4,dc2,test\n"
+	if err := os.WriteFile(file, []byte(hosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := testSettings(t, "{}")
+	c.Static.Sources = []string{file}
+	static := NewStatic(c)
+	static.Selection = Selection{Regions: []string{"dc2"}, Envs: []string{"prod"}}
+
+	instances, results := static.Discover(context.Background())
+	if len(instances) != 1 || instances[0].Name != "web3" {
+		t.Errorf("instances = %+v, want web3", instances)
+	}
+	if len(results) != 1 || results[0].Scope != (Scope{Provider: "static", Account: "dc", Region: "dc2", Env: "prod"}) {
+		t.Fatalf("results = %+v", results)
+	}
+	// Hosts left out of the selection are outside the scope, so they
+	// can't be taken for terminated.
+	for _, host := range []Instance{
+		{CloudProvider: "static", Account: "dc", Region: "dc1", ENV: "prod"},
+		{CloudProvider: "static", Account: "dc", Region: "dc2", ENV: "test"},
+	} {
+		if results[0].Scope.Covers(host) {
+			t.Errorf("%s covers %s/%s", results[0].Scope, host.Region, host.ENV)
+		}
+	}
+}
+
+func TestStaticDiscoverDuplicateAccount(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"a/hosts.yaml": "hosts:\n  - name: db1\n    address: 192.0.2.10\n",
+		"b/hosts.csv":  "name,address\nbench1,192.0.2.20\n",
+		"b/lab.csv":    "name,address\nbench2,192.0.2.21\n",
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := testSettings(t, "{}")
+	// b/lab.csv is named twice, once through its directory; that's no clash.
+	c.Static.Sources = []string{filepath.Join(dir, "a/hosts.yaml"), filepath.Join(dir, "b"), filepath.Join(dir, "b/lab.csv")}
+	instances, results := NewStatic(c).Discover(context.Background())
+
+	if len(instances) != 1 || instances[0].Name != "bench2" {
+		t.Errorf("instances = %+v, want bench2 only", instances)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %+v, want hosts and lab", results)
+	}
+	for _, r := range results {
+		switch r.Scope.Account {
+		case "hosts":
+			if r.Err == nil || !strings.Contains(r.Err.Error(), "more than one source") {
+				t.Errorf("hosts = %+v, want a failed scope", r)
+			}
+		case "lab":
+			if r.Err != nil || r.Count != 1 {
+				t.Errorf("lab = %+v", r)
+			}
+		default:
+			t.Errorf("unexpected scope %+v", r)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package inventoryengine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ascheel/goinventory/inventory/config"
+)
+
+// Timeouts limit a roll and its phases.  Zero means no limit, or for SSH,
+// sshtest.DefaultTimeout.
+type Timeouts struct {
+	Run    time.Duration
+	Scan   time.Duration
+	Logins time.Duration
+	Facts  time.Duration
+	SSH    time.Duration
+}
+
+// RollTimeouts reads inventory.timeouts.
+func RollTimeouts(c *config.Settings) (Timeouts, error) {
+	var timeouts Timeouts
+	t := c.Inventory.Timeouts
+	fields := []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"run", t.Run, &timeouts.Run},
+		{"scan", t.Scan, &timeouts.Scan},
+		{"logins", t.Logins, &timeouts.Logins},
+		{"facts", t.Facts, &timeouts.Facts},
+		{"ssh", t.SSH, &timeouts.SSH},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil || d <= 0 {
+			return timeouts, fmt.Errorf("bad inventory.timeouts.%s %q", f.name, f.value)
+		}
+		*f.d = d
+	}
+	return timeouts, nil
+}
+
+// phase runs one step of a roll, under its own timeout if it has one.  A
+// phase that runs out of time stops where it is; the roll carries on.
+func phase(ctx context.Context, name string, timeout time.Duration, fn func(context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%s timed out after %s", name, timeout))
+		defer cancel()
+	}
+	err := fn(ctx)
+	if ctx.Err() != nil {
+		slog.WarnContext(ctx, "Phase cut short", "phase", name, "err", context.Cause(ctx))
+	}
+	return err
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	//"github.com/ascheel/goinventory/config"
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	_ "embed"
 
 	"github.com/ascheel/goinventory/inventory/inventoryengine"
@@ -16,13 +23,365 @@ func printVersion() {
 	fmt.Println("Version: ", Version)
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [command] [options]\n\n", os.Args[0])
+	fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+	fmt.Fprintln(flag.CommandLine.Output(), "  roll        Refresh the inventory (default)")
+	fmt.Fprintln(flag.CommandLine.Output(), "  list        List instances matching a filter expression")
+	fmt.Fprintln(flag.CommandLine.Output(), "  ssh-config  Write an OpenSSH include file with a Host per instance")
+	fmt.Fprintln(flag.CommandLine.Output(), "  export      Write a static Ansible inventory to datadir, or a hosts file")
+	fmt.Fprintln(flag.CommandLine.Output(), "  names       Host names given by inventory.host_name, and their duplicates")
+	fmt.Fprintln(flag.CommandLine.Output(), "  serve       Serve a read-only HTTP API over the inventory")
+	fmt.Fprintln(flag.CommandLine.Output(), "  daemon      Refresh the inventory on an interval")
+	fmt.Fprintln(flag.CommandLine.Output(), "  compliance  Security agent compliance per account")
+	fmt.Fprintln(flag.CommandLine.Output(), "  ldap        Directory join and LDAP group access per instance")
+	fmt.Fprintln(flag.CommandLine.Output(), "  cmdb        Push instances to the CMDB and pull CI fields back")
+	fmt.Fprintln(flag.CommandLine.Output(), "  stale       Instances not seen by a scan for a number of days")
+	fmt.Fprintln(flag.CommandLine.Output(), "  diff        Instances added, removed or changed between two runs")
+	fmt.Fprintln(flag.CommandLine.Output(), "  version     Print the version")
+	fmt.Fprintln(flag.CommandLine.Output())
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.StringVar(&inventoryengine.ConfigFile, "config", inventoryengine.ConfigFile, "Settings file")
+	flag.StringVar(&inventoryengine.LogLevel, "log-level", "", "Log level: debug, info, warn or error (default log.level or info)")
+	flag.StringVar(&inventoryengine.LogFormat, "log-format", "", "Log format: text or json (default log.format or text)")
+	flag.StringVar(&inventoryengine.LogFile, "log-file", "", "Log to this file instead of stderr, relative to datadir (default log.file)")
+	flag.Usage = usage
+	flag.Parse()
+
+	command := "roll"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	var err error
+	if command != "version" {
+		if err := inventoryengine.NewInventory().SetupLogging(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	switch command {
+	case "roll":
+		printVersion()
+		err = roll(args)
+	case "list":
+		err = list(args)
+	case "ssh-config":
+		err = sshConfig(args)
+	case "export":
+		err = export(args)
+	case "names":
+		err = names(args)
+	case "serve":
+		err = serve(args)
+	case "daemon":
+		err = daemon(args)
+	case "compliance":
+		err = compliance(args)
+	case "ldap":
+		err = ldap(args)
+	case "cmdb":
+		err = cmdb(args)
+	case "stale":
+		err = stale(args)
+	case "diff":
+		err = diff(args)
+	case "version":
+		printVersion()
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		slog.Error(err.Error(), "command", command)
+		os.Exit(1)
+	}
+}
+
+func roll(args []string) error {
+	fs := flag.NewFlagSet("roll", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 0, "Stop the roll after this long, keeping what was found (default inventory.timeouts.run)")
+	regions := fs.String("region", "", "Comma separated regions to scan, by name or short code")
+	accounts := fs.String("account", "", "Comma separated accounts to scan, by name or number")
+	envs := fs.String("env", "", "Comma separated environments to scan")
+	allRegions := fs.Bool("all-regions", false, "Scan every configured region, not only the default ones")
+	forceTerminate := fs.Bool("force-terminate", false, "Mark missing instances terminated even beyond max_terminate_percent")
+	fs.Parse(args)
+
+	inv := inventoryengine.NewInventory()
+	inv.Selection = inventoryengine.Selection{
+		Regions:    splitList(*regions),
+		Accounts:   splitList(*accounts),
+		Envs:       splitList(*envs),
+		AllRegions: *allRegions,
+	}
+	inv.ForceTerminate = *forceTerminate
+
+	// Ctrl-C stops the roll early and keeps what was found; a second one
+	// kills it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		stop()
+	}(ctx)
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, *timeout, fmt.Errorf("timed out after %s", *timeout))
+		defer cancel()
+	}
+	return inv.Roll(ctx)
+}
+
+// splitList splits a comma separated flag value.
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s list [filter ...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Filter terms, all of which have to match:")
+		fmt.Fprintln(fs.Output(), "  field=pattern[,pattern]  field!=pattern  tag:Key  !tag:Key  tag:Key=pattern")
+		fmt.Fprintln(fs.Output(), "  launched-before=T  launched-after=T  last-seen-before=T  last-seen-after=T")
+		fmt.Fprintln(fs.Output(), "  sort=field[,-field]  limit=N")
+		fmt.Fprintln(fs.Output(), "Patterns may use * ? [...]; T is a date, RFC 3339 time or age (36h, 7d, 2w).")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "table", "Output format: "+strings.Join(inventoryengine.ListFormats, ", "))
+	columns := fs.String("columns", "", "Comma separated fields or tag:Key for table and csv")
+	tmpl := fs.String("template", "", "Go text/template run per instance (implies -format template)")
+	fs.Parse(args)
+
+	opts := inventoryengine.ListOptions{Format: *format, Template: *tmpl}
+	if *tmpl != "" {
+		opts.Format = "template"
+	}
+	var err error
+	opts.Columns, err = inventoryengine.ParseColumns(*columns)
+	if err != nil {
+		return err
+	}
+	filter, err := inventoryengine.ParseFilter(fs.Args()...)
+	if err != nil {
+		return err
+	}
+	instances, err := inventoryengine.NewInventory().FindInstances(filter)
+	if err != nil {
+		return err
+	}
+	return inventoryengine.WriteInstances(os.Stdout, instances, opts)
+}
+
+func sshConfig(args []string) error {
+	fs := flag.NewFlagSet("ssh-config", flag.ExitOnError)
+	output := fs.String("o", "", "Include file to write (default inventory.ssh_config or "+inventoryengine.DefaultSSHConfig+")")
+	all := fs.Bool("all", false, "Include terminated instances")
+	fs.Parse(args)
+
+	terms := fs.Args()
+	if !*all {
+		terms = append([]string{"state!=terminated"}, terms...)
+	}
+	filter, err := inventoryengine.ParseFilter(terms...)
+	if err != nil {
+		return err
+	}
+	file, count, err := inventoryengine.NewInventory().ExportSSHConfig(filter, *output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d hosts to %s\n", count, file)
+
+	home, _ := os.UserHomeDir()
+	if data, err := os.ReadFile(filepath.Join(home, ".ssh", "config")); err != nil || !strings.Contains(string(data), filepath.Base(file)) {
+		fmt.Printf("Add \"Include %s\" to the top of ~/.ssh/config to use it.\n", file)
+	}
+	return nil
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "ansible-ini", "Output format: ansible-ini or ansible-yaml (a new generation directory under datadir), ansible-json or hosts (to stdout)")
+	all := fs.Bool("all", false, "Include terminated instances")
+	fs.Parse(args)
+
+	terms := fs.Args()
+	if !*all {
+		terms = append([]string{"state!=terminated"}, terms...)
+	}
+	filter, err := inventoryengine.ParseFilter(terms...)
+	if err != nil {
+		return err
+	}
+	inv := inventoryengine.NewInventory()
+	switch *format {
+	case "ansible-json":
+		instances, err := inv.FindInstances(filter)
+		if err != nil {
+			return err
+		}
+		names, err := inventoryengine.NewHostNames(inv.Config(), instances)
+		if err != nil {
+			return err
+		}
+		return inventoryengine.BuildAnsibleInventory(inv.Config(), instances, names).WriteJSON(os.Stdout)
+	case "hosts":
+		return inv.ExportHosts(os.Stdout, filter)
+	}
+	dir, err := inv.ExportAnsible(filter, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", dir)
+	return nil
+}
+
+func names(args []string) error {
+	fs := flag.NewFlagSet("names", flag.ExitOnError)
+	format := fs.String("format", "table", "Output format: table or json")
+	duplicates := fs.Bool("duplicates", false, "Only list instances whose names collide")
+	all := fs.Bool("all", false, "Include terminated instances")
+	fs.Parse(args)
+
+	terms := fs.Args()
+	if !*all {
+		terms = append([]string{"state!=terminated"}, terms...)
+	}
+	filter, err := inventoryengine.ParseFilter(terms...)
+	if err != nil {
+		return err
+	}
+	inv := inventoryengine.NewInventory()
+	instances, err := inv.FindInstances(filter)
+	if err != nil {
+		return err
+	}
+	names, err := inventoryengine.NewHostNames(inv.Config(), instances)
+	if err != nil {
+		return err
+	}
+	return inventoryengine.WriteHostNames(os.Stdout, instances, names, *format, *duplicates)
+}
+
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to listen on")
+	refresh := fs.Duration("refresh", 0, "Refresh the inventory in the background this often (0 to never)")
+	fs.Parse(args)
+
+	inv := inventoryengine.NewInventory()
+	return inventoryengine.NewServer(inv).Serve(*listen, *refresh)
+}
+
+func daemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	interval := fs.Duration("interval", 0, "Time between rolls (default inventory.interval, or 1h)")
+	jitter := fs.Duration("jitter", 0, "Random extra delay of up to this much, with -interval")
+	fs.Parse(args)
+
 	printVersion()
+	return inventoryengine.NewInventory().Daemon(*interval, *jitter)
+}
 
-	i := inventoryengine.NewInventory()
-	err := i.Roll()
+func compliance(args []string) error {
+	fs := flag.NewFlagSet("compliance", flag.ExitOnError)
+	format := fs.String("format", "table", "Output format: table or json")
+	details := fs.Bool("details", false, "List non-compliant instances")
+	fs.Parse(args)
 
+	matrix, err := inventoryengine.NewInventory().ComplianceReport()
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	return inventoryengine.WriteComplianceReport(os.Stdout, matrix, *format, *details)
+}
+
+func ldap(args []string) error {
+	fs := flag.NewFlagSet("ldap", flag.ExitOnError)
+	format := fs.String("format", "table", "Output format: table or json")
+	all := fs.Bool("all", false, "Include instances without mismatches")
+	fs.Parse(args)
+
+	results, err := inventoryengine.NewInventory().LdapReport()
+	if err != nil {
+		return err
+	}
+	return inventoryengine.WriteLdapReport(os.Stdout, results, *format, *all)
+}
+
+func cmdb(args []string) error {
+	fs := flag.NewFlagSet("cmdb", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show what would change without writing")
+	pull := fs.Bool("pull", true, "Store CI fields from the CMDB as cmdb: tags and in the notes")
+	verbose := fs.Bool("v", false, "Also list unchanged records")
+	fs.Parse(args)
+
+	changes, err := inventoryengine.NewInventory().SyncCMDB(*dryRun, *pull)
+	if err != nil {
+		return err
+	}
+	inventoryengine.WriteCMDBChanges(os.Stdout, changes, *verbose)
+	return nil
+}
+
+func stale(args []string) error {
+	fs := flag.NewFlagSet("stale", flag.ExitOnError)
+	days := fs.Int("days", 7, "Days since an instance was last seen")
+	format := fs.String("format", "table", "Output format: table or json")
+	fs.Parse(args)
+
+	instances, err := inventoryengine.NewInventory().StaleReport(*days)
+	if err != nil {
+		return err
+	}
+	return inventoryengine.WriteStaleReport(os.Stdout, instances, *format)
+}
+
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff -from REF [-to REF]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "REF is now, a run ID, a backup file, or a date, RFC 3339 time or age (36h, 7d, 2w)")
+		fmt.Fprintln(fs.Output(), "for the latest backup taken by then.  Backups are kept with max_backups; without")
+		fmt.Fprintln(fs.Output(), "one, runs and times are compared through the history.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	from := fs.String("from", "", "Earlier snapshot")
+	to := fs.String("to", "now", "Later snapshot")
+	format := fs.String("format", "table", "Output format: table or json")
+	color := fs.String("color", "auto", "Color the table: auto, always or never")
+	fs.Parse(args)
+
+	if *from == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	diffs, err := inventoryengine.NewInventory().Diff(*from, *to)
+	if err != nil {
+		return err
+	}
+	colored := *color == "always"
+	if *color == "auto" {
+		stat, err := os.Stdout.Stat()
+		colored = err == nil && stat.Mode()&os.ModeCharDevice != 0
 	}
+	return inventoryengine.WriteDiff(os.Stdout, diffs, *format, colored)
 }
@@ -1,16 +1,15 @@
 package sshtest
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
 	"strings"
 
 	"golang.org/x/crypto/ssh"
 
 	//"golang.org/x/crypto/ssh/knownhosts"
-	"bufio"
 	"fmt"
-	"io"
 	//"path/filepath"
 
 	//"strconv"
@@ -36,8 +35,13 @@ type ConnectionInfo struct {
 	ErrCode  int
 	ErrText  string
 	ErrRaw   error
+	// Limits dialing and the SSH handshake.  Defaults to DefaultTimeout.
+	Timeout  time.Duration
 }
 
+// DefaultTimeout applies when ConnectionInfo.Timeout is unset.
+const DefaultTimeout = 5 * time.Second
+
 var connInfo ConnectionInfo
 
 // func init() {
@@ -67,29 +71,10 @@ var connInfo ConnectionInfo
 // 	}
 // }
 
-func check(e error) {
-	if e != nil {
-		log.Fatal(e)
-	}
-}
-
-func readSize(file *os.File) int64 {
-	stat, err := file.Stat()
-	check(err)
-	return stat.Size()
-}
-
-func readFile(filename string) []byte {
-	file, err := os.Open(filename)
-	check(err)
-	defer file.Close()
-	// Read the file into a byte slice
-	bs := make([]byte, readSize(file))
-	_, err = bufio.NewReader(file).Read(bs)
-	if err != nil && err != io.EOF {
-		fmt.Println(err)
-	}
-	return bs
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 type ConnectionInfoer interface {
@@ -100,18 +85,29 @@ type ConnectionInfoer interface {
 }
 
 func (connInfo *ConnectionInfo) SSHConnect() (*ssh.Client, *ssh.Session, error) {
+	return connInfo.SSHConnectContext(context.Background())
+}
+
+// SSHConnectContext is SSHConnect, giving up when ctx is done.
+func (connInfo *ConnectionInfo) SSHConnectContext(ctx context.Context) (*ssh.Client, *ssh.Session, error) {
 	var auth     []ssh.AuthMethod
 
 	hostString := net.JoinHostPort(connInfo.Host, connInfo.Port)
 
-	timeout, _ := time.ParseDuration("5s")
+	timeout := connInfo.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
 	if len(connInfo.Password) == 0 && len(connInfo.Key) == 0 {
-		log.Fatalln("Both key and password are empty.  One must be provided.")
+		return nil, nil, errors.New("both key and password are empty, one must be provided")
 	} else if len(connInfo.Key) > 0 {
-		keyData := readFile(connInfo.Key)
+		keyData, err := os.ReadFile(connInfo.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad key %s: %w", connInfo.Key, err)
+		}
 		pKey, keyErr := ssh.ParsePrivateKey(keyData)
 		if keyErr != nil {
-			log.Fatalln("Bad key: " + connInfo.Key)
+			return nil, nil, fmt.Errorf("bad key %s: %w", connInfo.Key, keyErr)
 		}
 		auth = []ssh.AuthMethod{ssh.PublicKeys(pKey)}
 	} else if len(connInfo.Password) > 0 {
@@ -125,17 +121,28 @@ func (connInfo *ConnectionInfo) SSHConnect() (*ssh.Client, *ssh.Session, error)
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	client, err := ssh.Dial(
-		"tcp",
-		hostString,
-		conf,
-	)
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hostString)
 	if err != nil {
 		return nil, nil, err
 	}
+	// The handshake knows nothing of ctx; closing the connection ends it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(timeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, hostString, conf)
+	if !stop() {
+		return nil, nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
 
 	session, err := client.NewSession()
 	if err != nil {
+		client.Close()
 		return nil, nil, err
 	}
 
@@ -143,31 +150,79 @@ func (connInfo *ConnectionInfo) SSHConnect() (*ssh.Client, *ssh.Session, error)
 }
 
 func (connInfo *ConnectionInfo) TryConnect() bool {
+	return connInfo.TryConnectContext(context.Background())
+}
+
+// TryConnectContext is TryConnect, giving up when ctx is done.
+func (connInfo *ConnectionInfo) TryConnectContext(ctx context.Context) bool {
 	if len(connInfo.Key) == 0 && len(connInfo.Password) == 0 {
-		log.Fatalln("No key or password provided.")
+		connInfo.ErrRaw = errors.New("no key or password provided")
+		return false
 	} else if len(connInfo.Key) > 0 && len(connInfo.Password) > 0 {
-		log.Fatalln("Application does not yet support passwords AND keys both.")
+		connInfo.ErrRaw = errors.New("application does not yet support passwords and keys both")
+		return false
 	} else if len(connInfo.Host) == 0 {
-		log.Fatalln("No host provided.")
+		connInfo.ErrRaw = errors.New("no host provided")
+		return false
 	}
-	client, session, err := connInfo.SSHConnect()
+	client, session, err := connInfo.SSHConnectContext(ctx)
 	connInfo.ErrRaw = err
 	if err != nil {
 		return false
 	}
 
+	defer client.Close()
+	defer context.AfterFunc(ctx, func() { client.Close() })()
+
 	command := "ls -l /"
 	_, err = session.CombinedOutput(command)
 	if err != nil {
+		connInfo.ErrRaw = err
 		return false
 	}
 	if client == nil || session == nil {
-		log.Fatal("You shouldn't get here.")
+		fatal("You shouldn't get here.")
 		return false
 	}
 	return true
 }
 
+// Client is an open connection that can run several commands.
+type Client struct {
+	client *ssh.Client
+}
+
+func (connInfo *ConnectionInfo) Connect() (*Client, error) {
+	return connInfo.ConnectContext(context.Background())
+}
+
+// ConnectContext is Connect, giving up when ctx is done.  Once connected,
+// the client is the caller's to close.
+func (connInfo *ConnectionInfo) ConnectContext(ctx context.Context) (*Client, error) {
+	client, session, err := connInfo.SSHConnectContext(ctx)
+	connInfo.ErrRaw = err
+	if err != nil {
+		return nil, err
+	}
+	session.Close()
+	return &Client{client: client}, nil
+}
+
+// Run executes a command in a new session and returns its combined output.
+func (c *Client) Run(command string) (string, error) {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(command)
+	return string(output), err
+}
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
 func (connInfo *ConnectionInfo) PrintStruct() {
 	s := reflect.ValueOf(&connInfo).Elem().Elem()
 	typeOfSSH := s.Type()
@@ -201,7 +256,7 @@ func (connInfo *ConnectionInfo) GetJson() string {
 	if len(connInfo.Password) == 0 { obj.Password = "" }
 	jsonData, err := json.MarshalIndent(obj, "", "    ")
 	if err != nil {
-		log.Fatalln("Failed to parse json output.")
+		fatal("Failed to parse json output.", "err", err)
 	}
 	return string(jsonData)
 }
@@ -245,6 +300,31 @@ func handleExit(connInfo *ConnectionInfo) {
 	os.Exit(connInfo.ErrCode)
 }
 
+// ErrorClass sorts a connection error into the classes handleExit reports:
+// "success", "auth", "timeout", "refused", "unreachable", "dns" or "other".
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case isAuthenticationError(err):
+		return "auth"
+	// The handshake error only keeps the text of a timed out read.
+	case os.IsTimeout(err), errors.Is(err, context.DeadlineExceeded), strings.Contains(err.Error(), "i/o timeout"):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case isDNSError(err):
+		return "dns"
+	}
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		return "dns"
+	}
+	return "other"
+}
+
 func isDNSError(err error) bool {
 	dnsKeywords := []string{
 		"no such host",